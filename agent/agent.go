@@ -19,6 +19,7 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -82,6 +83,10 @@ type Agent struct {
 	NatsPingInterval   int
 	NatsWSCompression  bool
 	Insecure           bool
+	RPCWorkers         int
+	RPCQueueSize       int
+	RPCControlWorkers  int
+	RPCControlQueue    int
 }
 
 const (
@@ -90,11 +95,14 @@ const (
 	winSvcName           = "tacticalrmm"
 	meshSvcName          = "mesh agent"
 	etcConfig            = "/etc/tacticalagent"
+	etcConfigDropInDir   = "/etc/tacticalagent.d"
+	configEnvPrefix      = "TRMM"
 	nixAgentDir          = "/opt/tacticalagent"
 	nixMeshDir           = "/opt/tacticalmesh"
 	nixAgentBin          = nixAgentDir + "/tacticalagent"
 	nixAgentBinDir       = nixAgentDir + "/bin"
 	nixAgentEtcDir       = nixAgentDir + "/etc"
+	nixLocalSocket       = "/var/run/tacticalagent.sock"
 	nixMeshAgentBin      = nixMeshDir + "/meshagent"
 	macPlistPath         = "/Library/LaunchDaemons/tacticalagent.plist"
 	macPlistName         = "tacticalagent"
@@ -106,6 +114,14 @@ var winMeshDir = filepath.Join(os.Getenv("PROGRAMFILES"), "Mesh Agent")
 var natsCheckin = []string{"agent-hello", "agent-agentinfo", "agent-disks", "agent-winsvc", "agent-publicip", "agent-wmi"}
 var limitNatsData = []string{"agent-winsvc", "agent-wmi"}
 
+// LogFilePath is where the agent logs to unless -logto stdout is used
+func LogFilePath() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("ProgramFiles"), progFilesName, "agent.log")
+	}
+	return filepath.Join("/var/log/", "tacticalagent.log")
+}
+
 func New(logger *logrus.Logger, version string) *Agent {
 	host, _ := ps.Host()
 	info := host.Info()
@@ -159,33 +175,11 @@ func New(logger *logrus.Logger, version string) *Agent {
 	ac := NewAgentConfig()
 
 	agentHeader := fmt.Sprintf("trmm/%s/%s/%s", version, runtime.GOOS, runtime.GOARCH)
-	headers := make(map[string]string)
-	if len(ac.Token) > 0 {
-		headers["Content-Type"] = "application/json"
-		headers["Authorization"] = fmt.Sprintf("Token %s", ac.Token)
-	}
+	headers := authHeaders(ac.Token)
 
 	insecure := ac.Insecure == "true"
 
-	restyC := resty.New()
-	restyC.SetBaseURL(ac.BaseURL)
-	restyC.SetCloseConnection(true)
-	restyC.SetHeaders(headers)
-	restyC.SetTimeout(15 * time.Second)
-	restyC.SetDebug(logger.IsLevelEnabled(logrus.DebugLevel))
-	if insecure {
-		insecureConf := &tls.Config{
-			InsecureSkipVerify: true,
-		}
-		restyC.SetTLSClientConfig(insecureConf)
-	}
-
-	if len(ac.Proxy) > 0 {
-		restyC.SetProxy(ac.Proxy)
-	}
-	if len(ac.Cert) > 0 {
-		restyC.SetRootCertificate(ac.Cert)
-	}
+	restyC := newRestyClient(ac, headers, logger.IsLevelEnabled(logrus.DebugLevel))
 
 	if len(ac.WinTmpDir) > 0 {
 		winTempDir = ac.WinTmpDir
@@ -227,30 +221,29 @@ func New(logger *logrus.Logger, version string) *Agent {
 		},
 	}
 
-	var natsProxyPath, natsProxyPort string
-	if ac.NatsProxyPath == "" {
-		natsProxyPath = "natsws"
-	}
+	ns := newNatsSettings(ac)
 
-	if ac.NatsProxyPort == "" {
-		natsProxyPort = "443"
+	// heavy rpc jobs (scripts, inventory) are capped to keep small vms responsive
+	rpcWorkers := ac.RPCWorkers
+	if rpcWorkers <= 0 {
+		rpcWorkers = runtime.NumCPU()
+		if rpcWorkers < 2 {
+			rpcWorkers = 2
+		} else if rpcWorkers > 8 {
+			rpcWorkers = 8
+		}
 	}
-
-	// check if using nats standard tcp, otherwise use nats websockets by default
-	var natsServer string
-	var natsWsCompression bool
-	if ac.NatsStandardPort != "" {
-		natsServer = fmt.Sprintf("tls://%s:%s", ac.APIURL, ac.NatsStandardPort)
-	} else {
-		natsServer = fmt.Sprintf("wss://%s:%s", ac.APIURL, natsProxyPort)
-		natsWsCompression = true
+	rpcQueueSize := ac.RPCQueueSize
+	if rpcQueueSize <= 0 {
+		rpcQueueSize = 32
 	}
-
-	var natsPingInterval int
-	if ac.NatsPingInterval == 0 {
-		natsPingInterval = randRange(35, 45)
-	} else {
-		natsPingInterval = ac.NatsPingInterval
+	rpcControlWorkers := ac.RPCControlWorkers
+	if rpcControlWorkers <= 0 {
+		rpcControlWorkers = 8
+	}
+	rpcControlQueue := ac.RPCControlQueue
+	if rpcControlQueue <= 0 {
+		rpcControlQueue = 128
 	}
 
 	return &Agent{
@@ -285,12 +278,16 @@ func New(logger *logrus.Logger, version string) *Agent {
 		Platform:           runtime.GOOS,
 		GoArch:             runtime.GOARCH,
 		ServiceConfig:      svcConf,
-		NatsServer:         natsServer,
-		NatsProxyPath:      natsProxyPath,
-		NatsProxyPort:      natsProxyPort,
-		NatsPingInterval:   natsPingInterval,
-		NatsWSCompression:  natsWsCompression,
+		NatsServer:         ns.server,
+		NatsProxyPath:      ns.proxyPath,
+		NatsProxyPort:      ns.proxyPort,
+		NatsPingInterval:   ns.pingInterval,
+		NatsWSCompression:  ns.wsCompression,
 		Insecure:           insecure,
+		RPCWorkers:         rpcWorkers,
+		RPCQueueSize:       rpcQueueSize,
+		RPCControlWorkers:  rpcControlWorkers,
+		RPCControlQueue:    rpcControlQueue,
 	}
 }
 
@@ -309,6 +306,7 @@ type CmdOptions struct {
 	IsExecutable bool
 	Detached     bool
 	EnvVars      []string
+	Requester    *JobRequester
 }
 
 func (a *Agent) NewCMDOpts() *CmdOptions {
@@ -354,6 +352,8 @@ func (a *Agent) CmdV2(c *CmdOptions) CmdStatus {
 		envCmd = gocmd.NewCmdOptions(cmdOptions, commandArray[0], commandArray[1:]...) // /bin/bash -c 'ls -l /var/log/...'
 	}
 
+	jobID := runningJobs.add(c.Requester, strings.Join(append([]string{envCmd.Name}, envCmd.Args...), " "), func() int { return envCmd.Status().PID })
+
 	var stdoutBuf bytes.Buffer
 	var stderrBuf bytes.Buffer
 	// Print STDOUT and STDERR lines streaming from Cmd
@@ -371,6 +371,9 @@ func (a *Agent) CmdV2(c *CmdOptions) CmdStatus {
 				}
 				fmt.Fprintln(&stdoutBuf, line)
 				a.Logger.Debugln(line)
+				if c.Requester != nil && c.Requester.Output != nil {
+					c.Requester.Output("stdout", line)
+				}
 
 			case line, open := <-envCmd.Stderr:
 				if !open {
@@ -379,6 +382,9 @@ func (a *Agent) CmdV2(c *CmdOptions) CmdStatus {
 				}
 				fmt.Fprintln(&stderrBuf, line)
 				a.Logger.Debugln(line)
+				if c.Requester != nil && c.Requester.Output != nil {
+					c.Requester.Output("stderr", line)
+				}
 			}
 		}
 	}()
@@ -406,6 +412,7 @@ func (a *Agent) CmdV2(c *CmdOptions) CmdStatus {
 		pid := envCmd.Status().PID
 		a.Logger.Debugln("Killing process with PID", pid)
 		KillProc(int32(pid))
+		runningJobs.remove(jobID)
 		finalStatus.Exit = 98
 		ret := CmdStatus{
 			Status: finalStatus,
@@ -426,10 +433,18 @@ func (a *Agent) CmdV2(c *CmdOptions) CmdStatus {
 		Stdout: CleanString(stdoutBuf.String()),
 		Stderr: CleanString(stderrBuf.String()),
 	}
+	if runningJobs.remove(jobID) {
+		ret.Stderr += "\nCancelled"
+	}
 	a.Logger.Debugf("%+v\n", ret)
 	return ret
 }
 
+// RunScript runs code with the given shell and returns stdout, stderr and the exit code
+func (a *Agent) RunScript(code string, shell string, args []string, timeout int, runasuser bool, envVars []string, nushellEnableConfig bool, denoDefaultPermissions string) (stdout, stderr string, exitcode int, e error) {
+	return a.runScript(nil, code, shell, args, timeout, runasuser, envVars, nushellEnableConfig, denoDefaultPermissions)
+}
+
 func (a *Agent) GetCPULoadAvg() int {
 	fallback := false
 	pyCode := `
@@ -501,25 +516,26 @@ func (a *Agent) SyncMeshNodeID() {
 		NodeID:  StripAll(id),
 	}
 
-	_, err = a.rClient.R().SetBody(payload).Post("/api/v3/syncmesh/")
+	_, err = a.restClient().R().SetBody(payload).Post("/api/v3/syncmesh/")
 	if err != nil {
 		a.Logger.Debugln("SyncMesh:", err)
 	}
 }
 
 func (a *Agent) setupNatsOptions() []nats.Option {
+	s := a.settings()
 	reconnectWait := randRange(2, 8)
 	opts := make([]nats.Option, 0)
 	opts = append(opts, nats.Name(a.AgentID))
-	opts = append(opts, nats.UserInfo(a.AgentID, a.Token))
+	opts = append(opts, nats.UserInfo(a.AgentID, s.Token))
 	opts = append(opts, nats.ReconnectWait(time.Duration(reconnectWait)*time.Second))
 	opts = append(opts, nats.RetryOnFailedConnect(true))
 	opts = append(opts, nats.IgnoreAuthErrorAbort())
-	opts = append(opts, nats.PingInterval(time.Duration(a.NatsPingInterval)*time.Second))
-	opts = append(opts, nats.Compression(a.NatsWSCompression))
+	opts = append(opts, nats.PingInterval(time.Duration(s.NatsPingInterval)*time.Second))
+	opts = append(opts, nats.Compression(s.NatsWSCompression))
 	opts = append(opts, nats.MaxReconnects(-1))
 	opts = append(opts, nats.ReconnectBufSize(-1))
-	opts = append(opts, nats.ProxyPath(a.NatsProxyPath))
+	opts = append(opts, nats.ProxyPath(s.NatsProxyPath))
 	opts = append(opts, nats.ReconnectJitter(500*time.Millisecond, 4*time.Second))
 	opts = append(opts, nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
 		a.Logger.Debugln("NATS disconnected:", err)
@@ -528,12 +544,13 @@ func (a *Agent) setupNatsOptions() []nats.Option {
 	opts = append(opts, nats.ReconnectHandler(func(nc *nats.Conn) {
 		a.Logger.Debugln("NATS reconnected")
 		a.Logger.Debugf("%+v\n", nc.Statistics)
+		go a.DrainOutbox()
 	}))
 	opts = append(opts, nats.ErrorHandler(func(nc *nats.Conn, sub *nats.Subscription, err error) {
 		a.Logger.Errorln("NATS error:", err)
 		a.Logger.Errorf("%+v\n", sub)
 	}))
-	if a.Insecure {
+	if s.Insecure {
 		insecureConf := &tls.Config{
 			InsecureSkipVerify: true,
 		}
@@ -559,7 +576,7 @@ func (a *Agent) GetUninstallExe() string {
 
 func (a *Agent) CleanupAgentUpdates() {
 	// TODO remove a.ProgramDir, updates are now in winTempDir
-	dirs := [3]string{a.WinTmpDir, os.Getenv("TMP"), a.ProgramDir}
+	dirs := [3]string{a.settings().WinTmpDir, os.Getenv("TMP"), a.ProgramDir}
 	for _, dir := range dirs {
 		err := os.Chdir(dir)
 		if err != nil {
@@ -593,7 +610,7 @@ func (a *Agent) CleanupAgentUpdates() {
 
 func (a *Agent) RunPythonCode(code string, timeout int, args []string) (string, error) {
 	content := []byte(code)
-	tmpfn, _ := os.CreateTemp(a.WinTmpDir, "*.py")
+	tmpfn, _ := os.CreateTemp(a.settings().WinTmpDir, "*.py")
 	if _, err := tmpfn.Write(content); err != nil {
 		a.Logger.Debugln(err)
 		return "", err
@@ -649,9 +666,13 @@ func createWinTempDir() error {
 }
 
 func (a *Agent) RunTask(id int) error {
+	return a.runTask(nil, id)
+}
+
+func (a *Agent) runTask(req *JobRequester, id int) error {
 	data := rmm.AutomatedTask{}
 	url := fmt.Sprintf("/api/v3/%d/%s/taskrunner/", id, a.AgentID)
-	r1, gerr := a.rClient.R().Get(url)
+	r1, gerr := a.restClient().R().Get(url)
 	if gerr != nil {
 		a.Logger.Debugln(gerr)
 		return gerr
@@ -670,10 +691,11 @@ func (a *Agent) RunTask(id int) error {
 	start := time.Now()
 
 	type TaskResult struct {
-		Stdout   string  `json:"stdout"`
-		Stderr   string  `json:"stderr"`
-		RetCode  int     `json:"retcode"`
-		ExecTime float64 `json:"execution_time"`
+		Stdout     string            `json:"stdout"`
+		Stderr     string            `json:"stderr"`
+		RetCode    int               `json:"retcode"`
+		ExecTime   float64           `json:"execution_time"`
+		Structured *rmm.ScriptOutput `json:"structured,omitempty"`
 	}
 
 	payload := TaskResult{}
@@ -683,12 +705,21 @@ func (a *Agent) RunTask(id int) error {
 
 		action_start := time.Now()
 		if action.ActionType == "script" {
-			stdout, stderr, retcode, err := a.RunScript(action.Code, action.Shell, action.Args, action.Timeout, action.RunAsUser, action.EnvVars, action.NushellEnableConfig, action.DenoDefaultPermissions)
+			stdout, stderr, retcode, err := a.runScript(req, action.Code, action.Shell, action.Args, action.Timeout, action.RunAsUser, action.EnvVars, action.NushellEnableConfig, action.DenoDefaultPermissions)
 
 			if err != nil {
 				a.Logger.Debugln(err)
 			}
 
+			// structured output of every script action is merged into one result
+			stdout, structured := parseScriptOutput(stdout)
+			if structured != nil {
+				if payload.Structured == nil {
+					payload.Structured = &rmm.ScriptOutput{}
+				}
+				mergeScriptOutput(payload.Structured, structured)
+			}
+
 			// add text to stdout showing which script ran if more than 1 script
 			action_exec_time := time.Since(action_start).Seconds()
 
@@ -728,6 +759,7 @@ func (a *Agent) RunTask(id int) error {
 				opts.Shell = action.Shell
 				opts.Command = action.Command
 				opts.Timeout = time.Duration(action.Timeout)
+				opts.Requester = req
 				out := a.CmdV2(opts)
 
 				if out.Status.Error != nil {
@@ -761,10 +793,6 @@ func (a *Agent) RunTask(id int) error {
 
 	payload.ExecTime = time.Since(start).Seconds()
 
-	_, perr := a.rClient.R().SetBody(payload).Patch(url)
-	if perr != nil {
-		a.Logger.Debugln(perr)
-		return perr
-	}
+	a.SendResult(a.restClient(), http.MethodPatch, url, payload, historyResultTTL)
 	return nil
 }
@@ -16,12 +16,19 @@ package agent
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/fs"
+	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -136,14 +143,56 @@ func (a *Agent) osString() string {
 	return fmt.Sprintf("%s %s %s %s", plat, h.PlatformVersion, h.KernelArch, h.KernelVersion)
 }
 
+// NewAgentConfig reads /etc/tacticalagent, then merges the json files in /etc/tacticalagent.d in lexical order
+// and finally applies TRMM_<KEY> environment variables, e.g. TRMM_PROXY or TRMM_NATSPINGINTERVAL.
+// Later sources override earlier ones.
 func NewAgentConfig() *rmm.AgentConfig {
+	var sources []string
+	var errs []error
+
 	viper.SetConfigName("tacticalagent")
 	viper.SetConfigType("json")
 	viper.AddConfigPath("/etc/")
 	viper.AddConfigPath(".")
 	err := viper.ReadInConfig()
 
-	if err != nil {
+	var notFound viper.ConfigFileNotFoundError
+	switch {
+	case err == nil:
+		sources = append(sources, viper.ConfigFileUsed())
+	case errors.As(err, &notFound) || errors.Is(err, fs.ErrNotExist):
+		// drop-ins and the environment can still provide the whole config, start from an empty one
+		viper.ReadConfig(strings.NewReader("{}"))
+	default:
+		setConfigLoad(nil, []error{err})
+		return &rmm.AgentConfig{}
+	}
+
+	dropIns, _ := filepath.Glob(filepath.Join(etcConfigDropInDir, "*.json"))
+	sort.Strings(dropIns)
+	for _, f := range dropIns {
+		b, err := os.ReadFile(f)
+		if err == nil {
+			err = viper.MergeConfig(bytes.NewReader(b))
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f, err))
+			continue
+		}
+		sources = append(sources, f)
+	}
+
+	viper.SetEnvPrefix(configEnvPrefix)
+	viper.AutomaticEnv()
+	for _, k := range configKeys {
+		env := configEnvPrefix + "_" + strings.ToUpper(k.key)
+		if _, ok := os.LookupEnv(env); ok && !k.winOnly {
+			sources = append(sources, "env:"+env)
+		}
+	}
+
+	setConfigLoad(sources, errs)
+	if len(sources) == 0 {
 		return &rmm.AgentConfig{}
 	}
 
@@ -151,25 +200,64 @@ func NewAgentConfig() *rmm.AgentConfig {
 	pk, _ := strconv.Atoi(agentpk)
 
 	ret := &rmm.AgentConfig{
-		BaseURL:          viper.GetString("baseurl"),
-		AgentID:          viper.GetString("agentid"),
-		APIURL:           viper.GetString("apiurl"),
-		Token:            viper.GetString("token"),
-		AgentPK:          agentpk,
-		PK:               pk,
-		Cert:             viper.GetString("cert"),
-		Proxy:            viper.GetString("proxy"),
-		CustomMeshDir:    viper.GetString("meshdir"),
-		NatsProxyPath:    viper.GetString("natsproxypath"),
-		NatsProxyPort:    viper.GetString("natsproxyport"),
-		NatsStandardPort: viper.GetString("natsstandardport"),
-		NatsPingInterval: viper.GetInt("natspinginterval"),
-		Insecure:         viper.GetString("insecure"),
+		BaseURL:           viper.GetString("baseurl"),
+		AgentID:           viper.GetString("agentid"),
+		APIURL:            viper.GetString("apiurl"),
+		Token:             viper.GetString("token"),
+		AgentPK:           agentpk,
+		PK:                pk,
+		Cert:              viper.GetString("cert"),
+		Proxy:             viper.GetString("proxy"),
+		CustomMeshDir:     viper.GetString("meshdir"),
+		NatsProxyPath:     viper.GetString("natsproxypath"),
+		NatsProxyPort:     viper.GetString("natsproxyport"),
+		NatsStandardPort:  viper.GetString("natsstandardport"),
+		NatsPingInterval:  viper.GetInt("natspinginterval"),
+		Insecure:          viper.GetString("insecure"),
+		RPCWorkers:        viper.GetInt("rpcworkers"),
+		RPCQueueSize:      viper.GetInt("rpcqueuesize"),
+		RPCControlWorkers: viper.GetInt("rpccontrolworkers"),
+		RPCControlQueue:   viper.GetInt("rpccontrolqueue"),
 	}
 	return ret
 }
 
-func (a *Agent) RunScript(code string, shell string, args []string, timeout int, runasuser bool, envVars []string, nushellEnableConfig bool, denoDefaultPermissions string) (stdout, stderr string, exitcode int, e error) {
+// saveAgentConfig updates keys in /etc/tacticalagent, other keys in the file are kept as they are.
+// The file is replaced atomically and keeps its permissions.
+func saveAgentConfig(values map[string]string) error {
+	b, err := os.ReadFile(etcConfig)
+	if err != nil {
+		return err
+	}
+	m := make(map[string]interface{})
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	for k, v := range values {
+		m[k] = v
+	}
+	out, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	mode := os.FileMode(0660)
+	if fi, err := os.Stat(etcConfig); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	tmp := etcConfig + ".tmp"
+	if err := os.WriteFile(tmp, out, mode); err != nil {
+		return err
+	}
+	// WriteFile is subject to the umask
+	if err := os.Chmod(tmp, mode); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, etcConfig)
+}
+
+func (a *Agent) runScript(req *JobRequester, code string, shell string, args []string, timeout int, runasuser bool, envVars []string, nushellEnableConfig bool, denoDefaultPermissions string) (stdout, stderr string, exitcode int, e error) {
 	code = removeWinNewLines(code)
 	content := []byte(code)
 
@@ -265,6 +353,7 @@ func (a *Agent) RunScript(code string, shell string, args []string, timeout int,
 
 	opts.EnvVars = envVars
 	opts.Timeout = time.Duration(timeout)
+	opts.Requester = req
 	a.Logger.Debugln("RunScript():", opts.Shell, opts.Args)
 	out := a.CmdV2(opts)
 	retError := ""
@@ -282,6 +371,43 @@ func SetDetached() *syscall.SysProcAttr {
 	return &syscall.SysProcAttr{Setpgid: true}
 }
 
+// killProcGroup kills pid and everything in its process group, CmdV2 starts every command in its own group
+func killProcGroup(pid int) error {
+	return syscall.Kill(-pid, syscall.SIGKILL)
+}
+
+// listenLocal creates the local api socket, only root can connect to it
+func listenLocal() (net.Listener, error) {
+	// left behind if the service was killed
+	os.Remove(nixLocalSocket)
+	l, err := net.Listen("unix", nixLocalSocket)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(nixLocalSocket, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func dialLocal(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "unix", nixLocalSocket)
+}
+
+// reloadOnSignal reloads the agent config every time the service gets a SIGHUP
+func (a *Agent) reloadOnSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		a.Logger.Infoln("SIGHUP received, reloading config")
+		if _, err := a.ReloadConfig(); err != nil {
+			a.Logger.Errorln("ReloadConfig():", err)
+		}
+	}
+}
+
 func (a *Agent) seEnforcing() bool {
 	opts := a.NewCMDOpts()
 	opts.Command = "getenforce"
@@ -315,10 +441,11 @@ func (a *Agent) AgentUpdate(url, inno, version string) error {
 	rClient.SetCloseConnection(true)
 	rClient.SetTimeout(15 * time.Minute)
 	rClient.SetDebug(a.Debug)
-	if len(a.Proxy) > 0 {
-		rClient.SetProxy(a.Proxy)
+	s := a.settings()
+	if len(s.Proxy) > 0 {
+		rClient.SetProxy(s.Proxy)
 	}
-	if a.Insecure {
+	if s.Insecure {
 		insecureConf := &tls.Config{
 			InsecureSkipVerify: true,
 		}
@@ -711,8 +838,8 @@ func (a *Agent) InstallNushell(force bool) {
 	rClient.SetRetryCount(10)
 	rClient.SetRetryWaitTime(1 * time.Minute)
 	rClient.SetRetryMaxWaitTime(15 * time.Minute)
-	if len(a.Proxy) > 0 {
-		rClient.SetProxy(a.Proxy)
+	if proxy := a.settings().Proxy; len(proxy) > 0 {
+		rClient.SetProxy(proxy)
 	}
 
 	r, err := rClient.R().SetOutput(tmpAssetName).Get(url)
@@ -848,8 +975,8 @@ func (a *Agent) InstallDeno(force bool) {
 	rClient.SetRetryCount(10)
 	rClient.SetRetryWaitTime(1 * time.Minute)
 	rClient.SetRetryMaxWaitTime(15 * time.Minute)
-	if len(a.Proxy) > 0 {
-		rClient.SetProxy(a.Proxy)
+	if proxy := a.settings().Proxy; len(proxy) > 0 {
+		rClient.SetProxy(proxy)
 	}
 
 	r, err := rClient.R().SetOutput(tmpAssetName).Get(url)
@@ -893,62 +1020,28 @@ func (a *Agent) InstallDeno(force bool) {
 }
 
 // GetAgentCheckInConfig will get the agent configuration from the server.
-// The Windows agent stores the configuration in the registry. The UNIX agent does not store the config.
+// The Windows agent can override the configuration in the registry. The UNIX agent uses the config as is,
+// the last config fetched from the server is cached by GetCheckInConfFromAPI().
 // @return AgentCheckInConfig
 func (a *Agent) GetAgentCheckInConfig(ret AgentCheckInConfig) AgentCheckInConfig {
-	// TODO: Persist the config to disk.
 	return ret
 }
 
 // windows only below TODO add into stub file
 func (a *Agent) PlatVer() (string, error) { return "", nil }
 
-func (a *Agent) SendSoftware() {}
-
 func (a *Agent) UninstallCleanup() {}
 
 func (a *Agent) RunMigrations() {}
 
-func GetServiceStatus(name string) (string, error) { return "", nil }
-
 func (a *Agent) GetPython(force bool) {}
 
-type SchedTask struct{ Name string }
-
-func (a *Agent) PatchMgmnt(enable bool) error { return nil }
-
-func (a *Agent) CreateSchedTask(st SchedTask) (bool, error) { return false, nil }
-
-func DeleteSchedTask(name string) error { return nil }
-
-func ListSchedTasks() []string { return []string{} }
-
-func (a *Agent) GetEventLog(logName string, searchLastDays int) []rmm.EventLogMsg {
-	return []rmm.EventLogMsg{}
-}
-
-func (a *Agent) GetServiceDetail(name string) trmm.WindowsService { return trmm.WindowsService{} }
-
-func (a *Agent) ControlService(name, action string) rmm.WinSvcResp {
-	return rmm.WinSvcResp{Success: false, ErrorMsg: "/na"}
-}
-
-func (a *Agent) EditService(name, startupType string) rmm.WinSvcResp {
-	return rmm.WinSvcResp{Success: false, ErrorMsg: "/na"}
-}
-
-func (a *Agent) GetInstalledSoftware() []trmm.WinSoftwareList { return []trmm.WinSoftwareList{} }
-
 func (a *Agent) ChecksRunning() bool { return false }
 
 func (a *Agent) InstallChoco() {}
 
 func (a *Agent) InstallWithChoco(name string) (string, error) { return "", nil }
 
-func (a *Agent) GetWinUpdates() {}
-
-func (a *Agent) InstallUpdates(guids []string) {}
-
 func (a *Agent) installMesh(meshbin, exe, proxy string) (string, error) {
 	return "not implemented", nil
 }
@@ -957,11 +1050,13 @@ func CMDShell(shell string, cmdArgs []string, command string, timeout int, detac
 	return [2]string{"", ""}, nil
 }
 
-func CMD(exe string, args []string, timeout int, detached bool) (output [2]string, e error) {
+func cmdShell(req *JobRequester, shell string, cmdArgs []string, command string, timeout int, detached bool, runasuser bool) (output [2]string, e error) {
 	return [2]string{"", ""}, nil
 }
 
-func (a *Agent) GetServices() []trmm.WindowsService { return []trmm.WindowsService{} }
+func CMD(exe string, args []string, timeout int, detached bool) (output [2]string, e error) {
+	return [2]string{"", ""}, nil
+}
 
 func (a *Agent) Start(_ service.Service) error { return nil }
 
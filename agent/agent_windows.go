@@ -17,6 +17,8 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -50,8 +52,10 @@ var (
 func NewAgentConfig() *rmm.AgentConfig {
 	k, err := registry.OpenKey(registry.LOCAL_MACHINE, `SOFTWARE\TacticalRMM`, registry.ALL_ACCESS)
 	if err != nil {
+		setConfigLoad(nil, []error{err})
 		return &rmm.AgentConfig{}
 	}
+	setConfigLoad([]string{`registry:HKLM\SOFTWARE\TacticalRMM`}, nil)
 
 	baseurl, _, _ := k.GetStringValue("BaseURL")
 	agentid, _, _ := k.GetStringValue("AgentID")
@@ -70,6 +74,14 @@ func NewAgentConfig() *rmm.AgentConfig {
 	natsPingInterval, _, _ := k.GetStringValue("NatsPingInterval")
 	npi, _ := strconv.Atoi(natsPingInterval)
 	insecure, _, _ := k.GetStringValue("Insecure")
+	rpcWorkers, _, _ := k.GetStringValue("RPCWorkers")
+	rpcw, _ := strconv.Atoi(rpcWorkers)
+	rpcQueueSize, _, _ := k.GetStringValue("RPCQueueSize")
+	rpcq, _ := strconv.Atoi(rpcQueueSize)
+	rpcControlWorkers, _, _ := k.GetStringValue("RPCControlWorkers")
+	rpccw, _ := strconv.Atoi(rpcControlWorkers)
+	rpcControlQueue, _, _ := k.GetStringValue("RPCControlQueue")
+	rpccq, _ := strconv.Atoi(rpcControlQueue)
 
 	return &rmm.AgentConfig{
 		BaseURL:            baseurl,
@@ -88,10 +100,30 @@ func NewAgentConfig() *rmm.AgentConfig {
 		NatsStandardPort:   natsStandardPort,
 		NatsPingInterval:   npi,
 		Insecure:           insecure,
+		RPCWorkers:         rpcw,
+		RPCQueueSize:       rpcq,
+		RPCControlWorkers:  rpccw,
+		RPCControlQueue:    rpccq,
 	}
 }
 
-func (a *Agent) RunScript(code string, shell string, args []string, timeout int, runasuser bool, envVars []string, nushellEnableConfig bool, denoDefaultPermissions string) (stdout, stderr string, exitcode int, e error) {
+// saveAgentConfig updates values in the TacticalRMM registry key
+func saveAgentConfig(values map[string]string) error {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, `SOFTWARE\TacticalRMM`, registry.ALL_ACCESS)
+	if err != nil {
+		return err
+	}
+	defer k.Close()
+
+	for key, v := range values {
+		if err := k.SetStringValue(configRegName(key), v); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func (a *Agent) runScript(req *JobRequester, code string, shell string, args []string, timeout int, runasuser bool, envVars []string, nushellEnableConfig bool, denoDefaultPermissions string) (stdout, stderr string, exitcode int, e error) {
 
 	content := []byte(code)
 
@@ -124,10 +156,11 @@ func (a *Agent) RunScript(code string, shell string, args []string, timeout int,
 		ext = "*.ts"
 	}
 
-	tmpDir := a.WinTmpDir
+	s := a.settings()
+	tmpDir := s.WinTmpDir
 
 	if runasuser {
-		tmpDir = a.WinRunAsUserTmpDir
+		tmpDir = s.WinRunAsUserTmpDir
 	}
 
 	tmpfn, err := os.CreateTemp(tmpDir, ext)
@@ -245,12 +278,21 @@ func (a *Agent) RunScript(code string, shell string, args []string, timeout int,
 	}
 	cmd.Stdout = &outb
 	cmd.Stderr = &errb
+	if req != nil && req.Output != nil {
+		stdoutLines := &lineWriter{stream: "stdout", output: req.Output}
+		stderrLines := &lineWriter{stream: "stderr", output: req.Output}
+		defer stdoutLines.Close()
+		defer stderrLines.Close()
+		cmd.Stdout = io.MultiWriter(&outb, stdoutLines)
+		cmd.Stderr = io.MultiWriter(&errb, stderrLines)
+	}
 
 	if cmdErr := cmd.Start(); cmdErr != nil {
 		a.Logger.Debugln(cmdErr)
 		return "", cmdErr.Error(), 65, cmdErr
 	}
 	pid := int32(cmd.Process.Pid)
+	jobID := runningJobs.add(req, cmd.String(), func() int { return int(pid) })
 
 	// custom context handling, we need to kill child procs if this is a batch script,
 	// otherwise it will hang forever
@@ -264,6 +306,7 @@ func (a *Agent) RunScript(code string, shell string, args []string, timeout int,
 	}(pid)
 
 	cmdErr := cmd.Wait()
+	cancelled := runningJobs.remove(jobID)
 
 	if timedOut {
 		stdout = CleanString(outb.String())
@@ -293,6 +336,9 @@ func (a *Agent) RunScript(code string, shell string, args []string, timeout int,
 				exitcode = 0
 			}
 		}
+		if cancelled {
+			stderr += "\nCancelled"
+		}
 	}
 	return stdout, stderr, exitcode, nil
 }
@@ -303,6 +349,24 @@ func SetDetached() *syscall.SysProcAttr {
 	}
 }
 
+// killProcGroup kills pid and its children, windows has no process groups we can signal
+func killProcGroup(pid int) error {
+	return KillProc(int32(pid))
+}
+
+var errNoLocalAPI = errors.New("the local api is not available on windows yet")
+
+func listenLocal() (net.Listener, error) {
+	return nil, errNoLocalAPI
+}
+
+func dialLocal(ctx context.Context) (net.Conn, error) {
+	return nil, errNoLocalAPI
+}
+
+// reloadOnSignal does nothing on windows, the config is reloaded with the reloadconfig rpc
+func (a *Agent) reloadOnSignal() {}
+
 func CMD(exe string, args []string, timeout int, detached bool) (output [2]string, e error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
 	defer cancel()
@@ -329,6 +393,11 @@ func CMD(exe string, args []string, timeout int, detached bool) (output [2]strin
 }
 
 func CMDShell(shell string, cmdArgs []string, command string, timeout int, detached bool, runasuser bool) (output [2]string, e error) {
+	return cmdShell(nil, shell, cmdArgs, command, timeout, detached, runasuser)
+}
+
+// cmdShell is CMDShell registering the command as a job of req
+func cmdShell(req *JobRequester, shell string, cmdArgs []string, command string, timeout int, detached bool, runasuser bool) (output [2]string, e error) {
 	var (
 		outb     bytes.Buffer
 		errb     bytes.Buffer
@@ -383,6 +452,8 @@ func CMDShell(shell string, cmdArgs []string, command string, timeout int, detac
 	cmd.Start()
 
 	pid := int32(cmd.Process.Pid)
+	jobID := runningJobs.add(req, cmd.String(), func() int { return int(pid) })
+	defer runningJobs.remove(jobID)
 
 	go func(p int32) {
 
@@ -501,12 +572,13 @@ func ShowStatus(version string) {
 			w32.ShowWindow(window, w32.SW_HIDE)
 		}
 		var handle w32.HWND
-		msg := fmt.Sprintf("Agent: %s\n\nMesh Agent: %s", statusMap[winSvcName], statusMap[meshSvcName])
+		msg := fmt.Sprintf("Agent: %s\n\nMesh Agent: %s\n\nOutbox: %d queued", statusMap[winSvcName], statusMap[meshSvcName], OutboxDepth())
 		w32.MessageBox(handle, msg, fmt.Sprintf("Tactical RMM v%s", version), w32.MB_OK|w32.MB_ICONINFORMATION)
 	} else {
 		fmt.Println("Tactical RMM Version", version)
 		fmt.Println("Tactical Agent:", statusMap[winSvcName])
 		fmt.Println("Mesh Agent:", statusMap[meshSvcName])
+		fmt.Println("Outbox:", OutboxDepth(), "queued")
 	}
 }
 
@@ -655,7 +727,7 @@ func (a *Agent) SendSoftware() {
 	a.Logger.Debugln(sw)
 
 	payload := map[string]interface{}{"agent_id": a.AgentID, "software": sw}
-	_, err := a.rClient.R().SetBody(payload).Post("/api/v3/software/")
+	_, err := a.restClient().R().SetBody(payload).Post("/api/v3/software/")
 	if err != nil {
 		a.Logger.Debugln(err)
 	}
@@ -666,8 +738,9 @@ func (a *Agent) UninstallCleanup() {
 	a.PatchMgmnt(false)
 	a.CleanupAgentUpdates()
 	CleanupSchedTasks()
-	os.RemoveAll(a.WinTmpDir)
-	os.RemoveAll(a.WinRunAsUserTmpDir)
+	s := a.settings()
+	os.RemoveAll(s.WinTmpDir)
+	os.RemoveAll(s.WinRunAsUserTmpDir)
 }
 
 func (a *Agent) AgentUpdate(url, inno, version string) error {
@@ -675,7 +748,7 @@ func (a *Agent) AgentUpdate(url, inno, version string) error {
 	a.KillHungUpdates()
 	time.Sleep(1 * time.Second)
 	a.CleanupAgentUpdates()
-	updater := filepath.Join(a.WinTmpDir, inno)
+	updater := filepath.Join(a.settings().WinTmpDir, inno)
 	a.Logger.Infof("Agent updating from %s to %s", a.Version, version)
 	a.Logger.Debugln("Downloading agent update from", url)
 
@@ -683,10 +756,11 @@ func (a *Agent) AgentUpdate(url, inno, version string) error {
 	rClient.SetCloseConnection(true)
 	rClient.SetTimeout(15 * time.Minute)
 	rClient.SetDebug(a.Debug)
-	if len(a.Proxy) > 0 {
-		rClient.SetProxy(a.Proxy)
+	s := a.settings()
+	if len(s.Proxy) > 0 {
+		rClient.SetProxy(s.Proxy)
 	}
-	if a.Insecure {
+	if s.Insecure {
 		insecureConf := &tls.Config{
 			InsecureSkipVerify: true,
 		}
@@ -703,7 +777,7 @@ func (a *Agent) AgentUpdate(url, inno, version string) error {
 		return errors.New(ret)
 	}
 
-	innoLogFile := filepath.Join(a.WinTmpDir, fmt.Sprintf("tacticalagent_update_v%s.txt", version))
+	innoLogFile := filepath.Join(a.settings().WinTmpDir, fmt.Sprintf("tacticalagent_update_v%s.txt", version))
 
 	args := []string{"/C", updater, "/VERYSILENT", fmt.Sprintf("/LOG=%s", innoLogFile)}
 	cmd := exec.Command("cmd.exe", args...)
@@ -875,8 +949,8 @@ func (a *Agent) GetPython(force bool) {
 	rClient.SetRetryCount(10)
 	rClient.SetRetryWaitTime(1 * time.Minute)
 	rClient.SetRetryMaxWaitTime(15 * time.Minute)
-	if len(a.Proxy) > 0 {
-		rClient.SetProxy(a.Proxy)
+	if proxy := a.settings().Proxy; len(proxy) > 0 {
+		rClient.SetProxy(proxy)
 	}
 
 	url := fmt.Sprintf("https://github.com/amidaware/rmmagent/releases/download/v2.8.0/%s", archZip)
@@ -1008,7 +1082,7 @@ func (a *Agent) InstallNushell(force bool) {
 		return
 	}
 
-	tmpDir, err := os.MkdirTemp(a.WinTmpDir, "nutemp")
+	tmpDir, err := os.MkdirTemp(a.settings().WinTmpDir, "nutemp")
 	if err != nil {
 		a.Logger.Errorln("InstallNushell(): Error creating nushell temp directory:", err)
 		return
@@ -1028,8 +1102,8 @@ func (a *Agent) InstallNushell(force bool) {
 	rClient.SetRetryCount(10)
 	rClient.SetRetryWaitTime(1 * time.Minute)
 	rClient.SetRetryMaxWaitTime(15 * time.Minute)
-	if len(a.Proxy) > 0 {
-		rClient.SetProxy(a.Proxy)
+	if proxy := a.settings().Proxy; len(proxy) > 0 {
+		rClient.SetProxy(proxy)
 	}
 
 	r, err := rClient.R().SetOutput(tmpAssetName).Get(url)
@@ -1133,7 +1207,7 @@ func (a *Agent) InstallDeno(force bool) {
 		return
 	}
 
-	tmpDir, err := os.MkdirTemp(a.WinTmpDir, "denotemp")
+	tmpDir, err := os.MkdirTemp(a.settings().WinTmpDir, "denotemp")
 	if err != nil {
 		a.Logger.Errorln("InstallDeno(): Error creating deno temp directory:", err)
 		return
@@ -1153,8 +1227,8 @@ func (a *Agent) InstallDeno(force bool) {
 	rClient.SetRetryCount(10)
 	rClient.SetRetryWaitTime(1 * time.Minute)
 	rClient.SetRetryMaxWaitTime(15 * time.Minute)
-	if len(a.Proxy) > 0 {
-		rClient.SetProxy(a.Proxy)
+	if proxy := a.settings().Proxy; len(proxy) > 0 {
+		rClient.SetProxy(proxy)
 	}
 
 	r, err := rClient.R().SetOutput(tmpAssetName).Get(url)
@@ -0,0 +1,69 @@
+/*
+Copyright 2023 AmidaWare Inc.
+
+Licensed under the Tactical RMM License Version 1.0 (the “License”).
+You may only use the Licensed Software in accordance with the License.
+A copy of the License is available at:
+
+https://license.tacticalrmm.com
+
+*/
+
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+)
+
+const (
+	checksCacheFile        = "checks.json"
+	checkIntervalCacheFile = "checkinterval.json"
+	checkInConfCacheFile   = "checkinconfig.json"
+)
+
+// apiUnreachable is set while the api cannot be reached so results are queued without waiting on a timeout
+var apiUnreachable uint32
+
+func setAPIUnreachable(down bool) {
+	if down {
+		atomic.StoreUint32(&apiUnreachable, 1)
+	} else {
+		atomic.StoreUint32(&apiUnreachable, 0)
+	}
+}
+
+func isAPIUnreachable() bool {
+	return atomic.LoadUint32(&apiUnreachable) == 1
+}
+
+// agentStateDir holds the data the agent keeps between restarts
+func agentStateDir() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("ProgramFiles"), progFilesName)
+	}
+	return nixAgentDir
+}
+
+func cachePath(name string) string {
+	return filepath.Join(agentStateDir(), "cache", name)
+}
+
+// writeCache atomically replaces the cached copy of an api response
+func writeCache(name string, data []byte) error {
+	path := cachePath(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readCache(name string) ([]byte, error) {
+	return os.ReadFile(cachePath(name))
+}
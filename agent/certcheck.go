@@ -0,0 +1,438 @@
+/*
+Copyright 2023 AmidaWare Inc.
+
+Licensed under the Tactical RMM License Version 1.0 (the “License”).
+You may only use the Licensed Software in accordance with the License.
+A copy of the License is available at:
+
+https://license.tacticalrmm.com
+
+*/
+
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	rmm "github.com/amidaware/rmmagent/shared"
+	"github.com/go-resty/resty/v2"
+)
+
+const (
+	certCheckWarnDays = 30
+	certCheckFailDays = 7
+)
+
+// ldapStartTLS is the LDAP extended request for StartTLS (RFC 4511 4.14), message id 1
+var ldapStartTLS = []byte{
+	0x30, 0x1d, 0x02, 0x01, 0x01, 0x77, 0x18, 0x80, 0x16,
+	'1', '.', '3', '.', '6', '.', '1', '.', '4', '.', '1', '.', '1', '4', '6', '6', '.', '2', '0', '0', '3', '7',
+}
+
+func (a *Agent) SendCertCheckResult(payload rmm.CertCheckResponse, r *resty.Client) {
+	a.SendResult(r, http.MethodPatch, "/api/v3/checkrunner/", payload, checkResultTTL)
+}
+
+// CertExpiryCheck checks the certificates in data.CertPath, a file, directory or glob of PEM or DER files,
+// or if no path is set the chain presented by data.IP on data.Port.
+// The status is warning when a certificate expires within data.WarnDays and failing within data.FailDays
+// or when it has a problem, like a chain that does not verify.
+// Served certificates that are not part of the verified chain, like an expired cross-sign, are listed as info only.
+func (a *Agent) CertExpiryCheck(data rmm.Check) (payload rmm.CertCheckResponse) {
+	payload.ID = data.CheckPK
+	payload.AgentID = a.AgentID
+	payload.Status = "failing"
+
+	var err error
+	if data.CertPath != "" {
+		payload.Certs, err = localCerts(data.CertPath)
+	} else {
+		payload.Certs, err = remoteCerts(data)
+	}
+	if err != nil {
+		a.Logger.Debugln("CertExpiryCheck:", err)
+		payload.MoreInfo = err.Error()
+		return
+	}
+	if len(payload.Certs) == 0 {
+		payload.MoreInfo = "No certificates found"
+		return
+	}
+
+	warnDays, failDays := data.WarnDays, data.FailDays
+	if warnDays <= 0 {
+		warnDays = certCheckWarnDays
+	}
+	if failDays <= 0 {
+		failDays = certCheckFailDays
+	}
+
+	payload.Status = "passing"
+	lines := make([]string, 0, len(payload.Certs))
+	for _, c := range payload.Certs {
+		switch {
+		case c.InfoOnly:
+		case c.DaysLeft < failDays || len(c.Problems) > 0:
+			payload.Status = "failing"
+		case c.DaysLeft < warnDays && payload.Status == "passing":
+			payload.Status = "warning"
+		}
+		line := fmt.Sprintf("%s: %s, issued by %s, expires %s (%d days)",
+			c.Source, c.Subject, c.Issuer, c.NotAfter.Format("2006-01-02"), c.DaysLeft)
+		if len(c.SANs) > 0 {
+			line += ", SANs: " + strings.Join(c.SANs, ", ")
+		}
+		if c.InfoOnly {
+			line += ", not in the verified chain"
+		}
+		for _, p := range c.Problems {
+			line += "\n  " + p
+		}
+		lines = append(lines, line)
+	}
+	payload.MoreInfo = strings.Join(lines, "\n")
+	return
+}
+
+func certInfo(source string, cert *x509.Certificate) rmm.CertInfo {
+	ret := rmm.CertInfo{
+		Source:    source,
+		Subject:   cert.Subject.String(),
+		Issuer:    cert.Issuer.String(),
+		SANs:      []string{},
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+		DaysLeft:  int(time.Until(cert.NotAfter).Hours() / 24),
+		Problems:  []string{},
+	}
+	ret.SANs = append(ret.SANs, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		ret.SANs = append(ret.SANs, ip.String())
+	}
+	ret.SANs = append(ret.SANs, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		ret.SANs = append(ret.SANs, u.String())
+	}
+
+	now := time.Now()
+	if now.After(cert.NotAfter) {
+		ret.Problems = append(ret.Problems, "expired")
+	}
+	if now.Before(cert.NotBefore) {
+		ret.Problems = append(ret.Problems, "not valid until "+cert.NotBefore.Format(time.RFC3339))
+	}
+	return ret
+}
+
+// remoteCerts returns the chain the server presents, the leaf has a problem if the chain does not verify for the server name.
+// Only the leaf and the verified chain count, served certificates outside it are info only
+// and a root from the system store that the server does not send is added.
+func remoteCerts(data rmm.Check) ([]rmm.CertInfo, error) {
+	starttls := strings.ToLower(data.StartTLS)
+	port := data.Port
+	if port <= 0 {
+		switch starttls {
+		case "smtp":
+			port = 25
+		case "imap":
+			port = 143
+		case "ldap":
+			port = 389
+		default:
+			port = 443
+		}
+	}
+	if data.IP == "" || port > 65535 {
+		return nil, fmt.Errorf("invalid host or port: %q %d", data.IP, port)
+	}
+	serverName := data.ServerName
+	if serverName == "" {
+		serverName = data.IP
+	}
+
+	addr := net.JoinHostPort(data.IP, strconv.Itoa(port))
+	timeout := checkTimeout(data)
+	conn, _, err := DialTCP(addr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s failed: %w", addr, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if starttls != "" {
+		if err := startTLS(conn, starttls); err != nil {
+			return nil, fmt.Errorf("%s starttls on %s failed: %w", starttls, addr, err)
+		}
+	}
+
+	// verified below so an invalid chain is still reported with its certificates
+	tconn := tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err := tconn.Handshake(); err != nil {
+		return nil, fmt.Errorf("tls handshake with %s failed: %w", addr, err)
+	}
+	peer := tconn.ConnectionState().PeerCertificates
+
+	ret := make([]rmm.CertInfo, 0, len(peer))
+	intermediates := x509.NewCertPool()
+	for i, cert := range peer {
+		source := addr
+		if i > 0 {
+			source = fmt.Sprintf("%s chain[%d]", addr, i)
+			intermediates.AddCert(cert)
+		}
+		ret = append(ret, certInfo(source, cert))
+	}
+	if len(peer) == 0 {
+		return ret, nil
+	}
+	chains, err := peer[0].Verify(x509.VerifyOptions{DNSName: serverName, Intermediates: intermediates})
+	if err != nil {
+		ret[0].Problems = append(ret[0].Problems, err.Error())
+	}
+	chain := longestLivedChain(chains)
+	for i, cert := range peer[1:] {
+		ret[i+1].InfoOnly = !containsCert(chain, cert)
+	}
+	for _, cert := range chain {
+		if !containsCert(peer, cert) {
+			ret = append(ret, certInfo(addr+" root", cert))
+		}
+	}
+	return ret, nil
+}
+
+// longestLivedChain picks the verified chain that stays valid the longest, it is the one clients keep using
+func longestLivedChain(chains [][]*x509.Certificate) []*x509.Certificate {
+	var ret []*x509.Certificate
+	var best time.Time
+	for _, chain := range chains {
+		var expires time.Time
+		for _, cert := range chain {
+			if expires.IsZero() || cert.NotAfter.Before(expires) {
+				expires = cert.NotAfter
+			}
+		}
+		if ret == nil || expires.After(best) {
+			ret, best = chain, expires
+		}
+	}
+	return ret
+}
+
+func containsCert(certs []*x509.Certificate, cert *x509.Certificate) bool {
+	for _, c := range certs {
+		if c.Equal(cert) {
+			return true
+		}
+	}
+	return false
+}
+
+// startTLS asks the server to upgrade conn to tls, proto is smtp, imap or ldap
+func startTLS(conn net.Conn, proto string) error {
+	rd := bufio.NewReader(conn)
+	switch proto {
+	case "smtp":
+		if err := smtpReply(rd, "220"); err != nil {
+			return err
+		}
+		if _, err := conn.Write([]byte("EHLO tacticalrmm-agent\r\n")); err != nil {
+			return err
+		}
+		if err := smtpReply(rd, "250"); err != nil {
+			return err
+		}
+		if _, err := conn.Write([]byte("STARTTLS\r\n")); err != nil {
+			return err
+		}
+		return smtpReply(rd, "220")
+	case "imap":
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(line, "* OK") {
+			return fmt.Errorf("unexpected greeting %q", strings.TrimSpace(line))
+		}
+		if _, err := conn.Write([]byte("a1 STARTTLS\r\n")); err != nil {
+			return err
+		}
+		for {
+			line, err := rd.ReadString('\n')
+			if err != nil {
+				return err
+			}
+			if strings.HasPrefix(line, "a1 ") {
+				if !strings.HasPrefix(line, "a1 OK") {
+					return fmt.Errorf("server replied %q", strings.TrimSpace(line))
+				}
+				return nil
+			}
+		}
+	case "ldap":
+		if _, err := conn.Write(ldapStartTLS); err != nil {
+			return err
+		}
+		return ldapReply(rd)
+	}
+	return fmt.Errorf("unsupported starttls protocol %q, use smtp, imap or ldap", proto)
+}
+
+// smtpReply reads a possibly multi-line smtp reply and checks its code
+func smtpReply(rd *bufio.Reader, code string) error {
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(line, code) {
+			return fmt.Errorf("server replied %q", strings.TrimSpace(line))
+		}
+		// "250-" continues the reply, "250 " ends it
+		if len(line) < 4 || line[3] != '-' {
+			return nil
+		}
+	}
+}
+
+// ldapReply reads the extended response to ldapStartTLS and checks its result code
+func ldapReply(rd *bufio.Reader) error {
+	var msg asn1.RawValue
+	var buf []byte
+	chunk := make([]byte, 512)
+	for {
+		n, err := rd.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+		if _, perr := asn1.Unmarshal(buf, &msg); perr == nil {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// LDAPMessage ::= SEQUENCE { messageID, ExtendedResponse [APPLICATION 24] { resultCode ENUMERATED, ... } }
+	var id int
+	rest, err := asn1.Unmarshal(msg.Bytes, &id)
+	if err != nil {
+		return err
+	}
+	var op asn1.RawValue
+	if _, err := asn1.Unmarshal(rest, &op); err != nil {
+		return err
+	}
+	if op.Class != asn1.ClassApplication || op.Tag != 24 {
+		return fmt.Errorf("unexpected ldap response tag %d", op.Tag)
+	}
+	var code asn1.Enumerated
+	if _, err := asn1.Unmarshal(op.Bytes, &code); err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("ldap result code %d", code)
+	}
+	return nil
+}
+
+// localCerts reads the certificates in path, a file, a directory or a glob.
+// Files without certificates are skipped unless path names the file.
+func localCerts(path string) ([]rmm.CertInfo, error) {
+	var files []string
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.Type().IsRegular() {
+				files = append(files, filepath.Join(path, e.Name()))
+			}
+		}
+	} else {
+		files, err = filepath.Glob(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("%s: no such file", path)
+		}
+	}
+	single := len(files) == 1 && files[0] == path
+
+	ret := make([]rmm.CertInfo, 0)
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			if single {
+				return nil, err
+			}
+			continue
+		}
+		certs, err := parseCerts(b)
+		if err == nil && len(certs) == 0 {
+			err = errors.New("empty file")
+		}
+		if err != nil {
+			if single {
+				return nil, fmt.Errorf("%s: no certificates: %w", f, err)
+			}
+			continue
+		}
+		for i, cert := range certs {
+			source := f
+			if len(certs) > 1 {
+				source = fmt.Sprintf("%s #%d", f, i+1)
+			}
+			info := certInfo(source, cert)
+			// a chain is leaf first, a bundle of unrelated certificates like a ca bundle is checked cert by cert
+			if i+1 < len(certs) && bytes.Equal(cert.RawIssuer, certs[i+1].RawSubject) {
+				if err := cert.CheckSignatureFrom(certs[i+1]); err != nil {
+					info.Problems = append(info.Problems, fmt.Sprintf("not signed by the next certificate in the file: %v", err))
+				}
+			}
+			ret = append(ret, info)
+		}
+	}
+	return ret, nil
+}
+
+// parseCerts reads PEM, other PEM blocks like keys are ignored, or DER
+func parseCerts(b []byte) ([]*x509.Certificate, error) {
+	if !bytes.Contains(b, []byte("-----BEGIN")) {
+		return x509.ParseCertificates(b)
+	}
+	var ret []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, cert)
+	}
+	if len(ret) == 0 {
+		return nil, errors.New("no CERTIFICATE blocks")
+	}
+	return ret, nil
+}
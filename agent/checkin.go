@@ -72,12 +72,14 @@ func (a *Agent) NatsMessage(nc *nats.Conn, mode string) {
 
 	a.Logger.Debugln(mode, payload)
 	ret.Encode(payload)
-	nc.PublishRequest(a.AgentID, mode, resp)
+	if err := nc.PublishRequest(a.AgentID, mode, resp); err == nil {
+		recordCheckin(mode)
+	}
 }
 
 func (a *Agent) DoNatsCheckIn() {
 	opts := a.setupNatsOptions()
-	nc, err := nats.Connect(a.NatsServer, opts...)
+	nc, err := nats.Connect(a.settings().NatsServer, opts...)
 	if err != nil {
 		a.Logger.Errorln(err)
 		return
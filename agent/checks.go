@@ -15,6 +15,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"math"
+	"net/http"
 	"runtime"
 	"strings"
 	"sync"
@@ -31,36 +32,84 @@ func (a *Agent) CheckRunner() {
 	a.Logger.Debugf("CheckRunner() init sleeping for %v seconds", sleepDelay)
 	time.Sleep(time.Duration(sleepDelay) * time.Second)
 	for {
+		// the interval comes from the cache when the api is down, the checks still run from their cache
 		interval, err := a.GetCheckInterval()
-		if err == nil && !a.ChecksRunning() {
+		if err != nil {
+			a.Logger.Debugln("Checkrunner GetCheckInterval", err)
+		}
+		if !a.ChecksRunning() {
 			if runtime.GOOS == "windows" {
 				_, err = CMD(a.EXE, []string{"-m", "checkrunner"}, 600, false)
 				if err != nil {
 					a.Logger.Errorln("Checkrunner RunChecks", err)
 				}
 			} else {
-				a.RunChecks(false)
+				err = a.RunChecks(false)
 			}
+			recordCheckRun(err)
 		}
 		a.Logger.Debugln("Checkrunner sleeping for", interval)
 		time.Sleep(time.Duration(interval) * time.Second)
 	}
 }
 
+// forceRunChecks runs every check now, on windows in a separate process like the check runner
+func (a *Agent) forceRunChecks() {
+	a.Logger.Debugln("Running checks")
+	if runtime.GOOS == "windows" {
+		_, checkerr := CMD(a.EXE, []string{"-m", "runchecks"}, 600, false)
+		if checkerr != nil {
+			a.Logger.Errorln("RPC RunChecks", checkerr)
+		}
+	} else {
+		a.RunChecks(true)
+	}
+}
+
+// checks that keep running from the cached definitions while the api is unreachable
+var offlineCheckTypes = []string{"diskspace", "memory", "cpuload", "ping", "script", "http", "tcp", "certexpiry", "dns", "process"}
+
 func (a *Agent) GetCheckInterval() (int, error) {
-	r, err := a.rClient.R().SetResult(&rmm.CheckInfo{}).Get(fmt.Sprintf("/api/v3/%s/checkinterval/", a.AgentID))
+	r, err := a.restClient().R().SetResult(&rmm.CheckInfo{}).Get(fmt.Sprintf("/api/v3/%s/checkinterval/", a.AgentID))
 	if err != nil {
 		a.Logger.Debugln(err)
-		return 120, err
+		return a.cachedCheckInterval(), err
 	}
 	if r.IsError() {
 		a.Logger.Debugln("Checkinterval response code:", r.StatusCode())
-		return 120, fmt.Errorf("checkinterval response code: %v", r.StatusCode())
+		return a.cachedCheckInterval(), fmt.Errorf("checkinterval response code: %v", r.StatusCode())
 	}
 	interval := r.Result().(*rmm.CheckInfo).Interval
+	if err := writeCache(checkIntervalCacheFile, r.Body()); err != nil {
+		a.Logger.Debugln("GetCheckInterval() cache:", err)
+	}
 	return interval, nil
 }
 
+// cachedCheckInterval returns the last interval sent by the api, 120 if it was never fetched
+func (a *Agent) cachedCheckInterval() int {
+	b, err := readCache(checkIntervalCacheFile)
+	if err != nil {
+		return 120
+	}
+	var info rmm.CheckInfo
+	if err := json.Unmarshal(b, &info); err != nil || info.Interval <= 0 {
+		return 120
+	}
+	return info.Interval
+}
+
+// cachedChecks returns the last check definitions received from the api
+func (a *Agent) cachedChecks() (rmm.AllChecks, error) {
+	data := rmm.AllChecks{}
+	b, err := readCache(checksCacheFile)
+	if err != nil {
+		return data, err
+	}
+	err = json.Unmarshal(b, &data)
+	return data, err
+}
+
 func (a *Agent) RunChecks(force bool) error {
 	data := rmm.AllChecks{}
 	var url string
@@ -69,20 +118,50 @@ func (a *Agent) RunChecks(force bool) error {
 	} else {
 		url = fmt.Sprintf("/api/v3/%s/checkrunner/", a.AgentID)
 	}
-	r, err := a.rClient.R().Get(url)
-	if err != nil {
-		a.Logger.Debugln(err)
-		return err
-	}
 
-	if r.IsError() {
+	offline := false
+	r, err := a.restClient().R().Get(url)
+	switch {
+	case err != nil || r.StatusCode() >= 500:
+		if err != nil {
+			a.Logger.Debugln(err)
+		} else {
+			a.Logger.Debugln("Checkrunner response code:", r.StatusCode())
+		}
+		cached, cerr := a.cachedChecks()
+		if cerr != nil {
+			a.Logger.Debugln("RunChecks() no cached checks:", cerr)
+			if err == nil {
+				return nil
+			}
+			return err
+		}
+		a.Logger.Debugln("RunChecks() api unreachable, running cached checks")
+		setAPIUnreachable(true)
+		offline = true
+		data = cached
+	case r.IsError():
 		a.Logger.Debugln("Checkrunner response code:", r.StatusCode())
 		return nil
+	default:
+		setAPIUnreachable(false)
+		if err := json.Unmarshal(r.Body(), &data); err != nil {
+			a.Logger.Debugln(err)
+			return err
+		}
+		if err := writeCache(checksCacheFile, r.Body()); err != nil {
+			a.Logger.Debugln("RunChecks() cache:", err)
+		}
 	}
 
-	if err := json.Unmarshal(r.Body(), &data); err != nil {
-		a.Logger.Debugln(err)
-		return err
+	if offline {
+		checks := make([]rmm.Check, 0, len(data.Checks))
+		for _, c := range data.Checks {
+			if stringInSlice(c.CheckType, offlineCheckTypes) {
+				checks = append(checks, c)
+			}
+		}
+		data.Checks = checks
 	}
 
 	var wg sync.WaitGroup
@@ -97,34 +176,69 @@ func (a *Agent) RunChecks(force bool) error {
 				defer wg.Done()
 				randomCheckDelay()
 				a.SendDiskCheckResult(a.DiskCheck(c), r)
-			}(check, &wg, a.rClient)
+			}(check, &wg, a.restClient())
 		case "cpuload":
 			wg.Add(1)
 			go func(c rmm.Check, wg *sync.WaitGroup, r *resty.Client) {
 				defer wg.Done()
 				a.CPULoadCheck(c, r)
-			}(check, &wg, a.rClient)
+			}(check, &wg, a.restClient())
 		case "memory":
 			wg.Add(1)
 			go func(c rmm.Check, wg *sync.WaitGroup, r *resty.Client) {
 				defer wg.Done()
 				randomCheckDelay()
 				a.MemCheck(c, r)
-			}(check, &wg, a.rClient)
+			}(check, &wg, a.restClient())
 		case "ping":
 			wg.Add(1)
 			go func(c rmm.Check, wg *sync.WaitGroup, r *resty.Client) {
 				defer wg.Done()
 				randomCheckDelay()
 				a.SendPingCheckResult(a.PingCheck(c), r)
-			}(check, &wg, a.rClient)
+			}(check, &wg, a.restClient())
+		case "http":
+			wg.Add(1)
+			go func(c rmm.Check, wg *sync.WaitGroup, r *resty.Client) {
+				defer wg.Done()
+				randomCheckDelay()
+				a.SendHTTPCheckResult(a.HTTPCheck(c), r)
+			}(check, &wg, a.restClient())
+		case "tcp":
+			wg.Add(1)
+			go func(c rmm.Check, wg *sync.WaitGroup, r *resty.Client) {
+				defer wg.Done()
+				randomCheckDelay()
+				a.SendTCPCheckResult(a.TCPCheck(c), r)
+			}(check, &wg, a.restClient())
+		case "certexpiry":
+			wg.Add(1)
+			go func(c rmm.Check, wg *sync.WaitGroup, r *resty.Client) {
+				defer wg.Done()
+				randomCheckDelay()
+				a.SendCertCheckResult(a.CertExpiryCheck(c), r)
+			}(check, &wg, a.restClient())
+		case "dns":
+			wg.Add(1)
+			go func(c rmm.Check, wg *sync.WaitGroup, r *resty.Client) {
+				defer wg.Done()
+				randomCheckDelay()
+				a.SendDNSCheckResult(a.DNSCheck(c), r)
+			}(check, &wg, a.restClient())
+		case "process":
+			wg.Add(1)
+			go func(c rmm.Check, wg *sync.WaitGroup, r *resty.Client) {
+				defer wg.Done()
+				randomCheckDelay()
+				a.SendProcessCheckResult(a.ProcessCheck(c), r)
+			}(check, &wg, a.restClient())
 		case "script":
 			wg.Add(1)
 			go func(c rmm.Check, wg *sync.WaitGroup, r *resty.Client) {
 				defer wg.Done()
 				randomCheckDelay()
 				a.ScriptCheck(c, r)
-			}(check, &wg, a.rClient)
+			}(check, &wg, a.restClient())
 		case "winsvc":
 			winServiceChecks = append(winServiceChecks, check)
 		case "eventlog":
@@ -141,7 +255,7 @@ func (a *Agent) RunChecks(force bool) error {
 				defer wg.Done()
 				a.SendWinSvcCheckResult(a.WinSvcCheck(winSvcCheck), r)
 			}
-		}(&wg, a.rClient)
+		}(&wg, a.restClient())
 	}
 
 	if len(eventLogChecks) > 0 {
@@ -151,19 +265,20 @@ func (a *Agent) RunChecks(force bool) error {
 				defer wg.Done()
 				a.EventLogCheck(evtCheck, r)
 			}
-		}(&wg, a.rClient)
+		}(&wg, a.restClient())
 	}
 	wg.Wait()
 	return nil
 }
 
 type ScriptCheckResult struct {
-	ID      int     `json:"id"`
-	AgentID string  `json:"agent_id"`
-	Stdout  string  `json:"stdout"`
-	Stderr  string  `json:"stderr"`
-	Retcode int     `json:"retcode"`
-	Runtime float64 `json:"runtime"`
+	ID         int               `json:"id"`
+	AgentID    string            `json:"agent_id"`
+	Stdout     string            `json:"stdout"`
+	Stderr     string            `json:"stderr"`
+	Retcode    int               `json:"retcode"`
+	Runtime    float64           `json:"runtime"`
+	Structured *rmm.ScriptOutput `json:"structured,omitempty"`
 }
 
 // ScriptCheck runs either bat, powershell or python script
@@ -171,26 +286,23 @@ func (a *Agent) ScriptCheck(data rmm.Check, r *resty.Client) {
 	start := time.Now()
 	stdout, stderr, retcode, _ := a.RunScript(data.Script.Code, data.Script.Shell, data.ScriptArgs, data.Timeout, data.Script.RunAsUser, data.EnvVars, data.NushellEnableConfig, data.DenoDefaultPermissions)
 
+	stdout, structured := parseScriptOutput(stdout)
+
 	payload := ScriptCheckResult{
-		ID:      data.CheckPK,
-		AgentID: a.AgentID,
-		Stdout:  stdout,
-		Stderr:  stderr,
-		Retcode: retcode,
-		Runtime: time.Since(start).Seconds(),
+		ID:         data.CheckPK,
+		AgentID:    a.AgentID,
+		Stdout:     stdout,
+		Stderr:     stderr,
+		Retcode:    retcode,
+		Runtime:    time.Since(start).Seconds(),
+		Structured: structured,
 	}
 
-	_, err := r.R().SetBody(payload).Patch("/api/v3/checkrunner/")
-	if err != nil {
-		a.Logger.Debugln(err)
-	}
+	a.SendResult(r, http.MethodPatch, "/api/v3/checkrunner/", payload, checkResultTTL)
 }
 
 func (a *Agent) SendDiskCheckResult(payload DiskCheckResult, r *resty.Client) {
-	_, err := r.R().SetBody(payload).Patch("/api/v3/checkrunner/")
-	if err != nil {
-		a.Logger.Debugln(err)
-	}
+	a.SendResult(r, http.MethodPatch, "/api/v3/checkrunner/", payload, checkResultTTL)
 }
 
 type DiskCheckResult struct {
@@ -229,10 +341,7 @@ type CPUMemResult struct {
 // CPULoadCheck checks avg cpu load
 func (a *Agent) CPULoadCheck(data rmm.Check, r *resty.Client) {
 	payload := CPUMemResult{ID: data.CheckPK, AgentID: a.AgentID, Percent: a.GetCPULoadAvg()}
-	_, err := r.R().SetBody(payload).Patch("/api/v3/checkrunner/")
-	if err != nil {
-		a.Logger.Debugln(err)
-	}
+	a.SendResult(r, http.MethodPatch, "/api/v3/checkrunner/", payload, checkResultTTL)
 }
 
 // MemCheck checks mem percentage
@@ -242,10 +351,7 @@ func (a *Agent) MemCheck(data rmm.Check, r *resty.Client) {
 	percent := (float64(mem.Used) / float64(mem.Total)) * 100
 
 	payload := CPUMemResult{ID: data.CheckPK, AgentID: a.AgentID, Percent: int(math.Round(percent))}
-	_, err := r.R().SetBody(payload).Patch("/api/v3/checkrunner/")
-	if err != nil {
-		a.Logger.Debugln(err)
-	}
+	a.SendResult(r, http.MethodPatch, "/api/v3/checkrunner/", payload, checkResultTTL)
 }
 
 type EventLogCheckResult struct {
@@ -306,17 +412,11 @@ func (a *Agent) EventLogCheck(data rmm.Check, r *resty.Client) {
 	}
 
 	payload := EventLogCheckResult{ID: data.CheckPK, AgentID: a.AgentID, Log: log}
-	_, err := r.R().SetBody(payload).Patch("/api/v3/checkrunner/")
-	if err != nil {
-		a.Logger.Debugln(err)
-	}
+	a.SendResult(r, http.MethodPatch, "/api/v3/checkrunner/", payload, checkResultTTL)
 }
 
 func (a *Agent) SendPingCheckResult(payload rmm.PingCheckResponse, r *resty.Client) {
-	_, err := r.R().SetBody(payload).Patch("/api/v3/checkrunner/")
-	if err != nil {
-		a.Logger.Debugln(err)
-	}
+	a.SendResult(r, http.MethodPatch, "/api/v3/checkrunner/", payload, checkResultTTL)
 }
 
 func (a *Agent) PingCheck(data rmm.Check) (payload rmm.PingCheckResponse) {
@@ -344,10 +444,7 @@ type WinSvcCheckResult struct {
 }
 
 func (a *Agent) SendWinSvcCheckResult(payload WinSvcCheckResult, r *resty.Client) {
-	_, err := r.R().SetBody(payload).Patch("/api/v3/checkrunner/")
-	if err != nil {
-		a.Logger.Debugln(err)
-	}
+	a.SendResult(r, http.MethodPatch, "/api/v3/checkrunner/", payload, checkResultTTL)
 }
 
 func (a *Agent) WinSvcCheck(data rmm.Check) (payload WinSvcCheckResult) {
@@ -29,36 +29,36 @@ func (a *Agent) InstallChoco() {
 
 	rClient := resty.New()
 	rClient.SetTimeout(30 * time.Second)
-	if len(a.Proxy) > 0 {
-		rClient.SetProxy(a.Proxy)
+	if proxy := a.settings().Proxy; len(proxy) > 0 {
+		rClient.SetProxy(proxy)
 	}
 
 	url := "/api/v3/choco/"
 	r, err := rClient.R().Get("https://chocolatey.org/install.ps1")
 	if err != nil {
 		a.Logger.Debugln(err)
-		a.rClient.R().SetBody(result).Post(url)
+		a.restClient().R().SetBody(result).Post(url)
 		return
 	}
 	if r.IsError() {
-		a.rClient.R().SetBody(result).Post(url)
+		a.restClient().R().SetBody(result).Post(url)
 		return
 	}
 
 	_, _, exitcode, err := a.RunScript(string(r.Body()), "powershell", []string{}, 900, false, []string{}, false, "")
 	if err != nil {
 		a.Logger.Debugln(err)
-		a.rClient.R().SetBody(result).Post(url)
+		a.restClient().R().SetBody(result).Post(url)
 		return
 	}
 
 	if exitcode != 0 {
-		a.rClient.R().SetBody(result).Post(url)
+		a.restClient().R().SetBody(result).Post(url)
 		return
 	}
 
 	result.Installed = true
-	a.rClient.R().SetBody(result).Post(url)
+	a.restClient().R().SetBody(result).Post(url)
 }
 
 func (a *Agent) InstallWithChoco(name string) (string, error) {
@@ -0,0 +1,200 @@
+/*
+Copyright 2023 AmidaWare Inc.
+
+Licensed under the Tactical RMM License Version 1.0 (the “License”).
+You may only use the Licensed Software in accordance with the License.
+A copy of the License is available at:
+
+https://license.tacticalrmm.com
+
+*/
+
+package agent
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	rmm "github.com/amidaware/rmmagent/shared"
+	"github.com/go-resty/resty/v2"
+)
+
+// configLoad records where the last NewAgentConfig() call got its settings from, in the order they were applied
+var configLoad struct {
+	sync.Mutex
+	sources []string
+	errs    []error
+}
+
+func setConfigLoad(sources []string, errs []error) {
+	configLoad.Lock()
+	defer configLoad.Unlock()
+	configLoad.sources = sources
+	configLoad.errs = errs
+}
+
+// ConfigSources returns the files and environment variables the agent config was built from
+// and the problems found reading them, a source with errors is skipped.
+func ConfigSources() ([]string, []error) {
+	configLoad.Lock()
+	defer configLoad.Unlock()
+	return append([]string{}, configLoad.sources...), append([]error{}, configLoad.errs...)
+}
+
+// ValidateAgentConfig checks the settings the agent cannot run without and the format of the optional ones.
+// Every problem found is returned, not just the first one.
+func ValidateAgentConfig(ac *rmm.AgentConfig) error {
+	var errs []error
+
+	if ac.AgentID == "" {
+		errs = append(errs, errors.New("agentid is empty"))
+	}
+	if _, err := strconv.Atoi(ac.AgentPK); err != nil {
+		errs = append(errs, fmt.Errorf("agentpk %q is not a number", ac.AgentPK))
+	}
+	if ac.Token == "" {
+		errs = append(errs, errors.New("token is empty"))
+	}
+	if err := validateURL(ac.BaseURL, "http", "https"); err != nil {
+		errs = append(errs, fmt.Errorf("baseurl: %w", err))
+	}
+	if ac.APIURL == "" {
+		errs = append(errs, errors.New("apiurl is empty"))
+	} else if strings.ContainsAny(ac.APIURL, "/ ") {
+		errs = append(errs, fmt.Errorf("apiurl %q must be a host name", ac.APIURL))
+	}
+	if ac.Proxy != "" {
+		if err := validateURL(ac.Proxy, "http", "https", "socks5"); err != nil {
+			errs = append(errs, fmt.Errorf("proxy: %w", err))
+		}
+	}
+	if ac.Cert != "" {
+		if fi, err := os.Stat(ac.Cert); err != nil {
+			errs = append(errs, fmt.Errorf("cert: %w", err))
+		} else if fi.IsDir() {
+			errs = append(errs, fmt.Errorf("cert: %s is a directory", ac.Cert))
+		}
+	}
+	if err := validatePort(ac.NatsStandardPort); err != nil {
+		errs = append(errs, fmt.Errorf("natsstandardport: %w", err))
+	}
+	if err := validatePort(ac.NatsProxyPort); err != nil {
+		errs = append(errs, fmt.Errorf("natsproxyport: %w", err))
+	}
+	if ac.NatsPingInterval < 0 {
+		errs = append(errs, fmt.Errorf("natspinginterval %d is negative", ac.NatsPingInterval))
+	}
+	switch ac.Insecure {
+	case "", "true", "false":
+	default:
+		errs = append(errs, fmt.Errorf("insecure must be true or false, got %q", ac.Insecure))
+	}
+	if ac.RPCWorkers < 0 || ac.RPCQueueSize < 0 || ac.RPCControlWorkers < 0 || ac.RPCControlQueue < 0 {
+		errs = append(errs, errors.New("rpc worker and queue sizes cannot be negative"))
+	}
+
+	return errors.Join(errs...)
+}
+
+func validateURL(s string, schemes ...string) error {
+	if s == "" {
+		return errors.New("is empty")
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if !stringInSlice(u.Scheme, schemes) {
+		return fmt.Errorf("%q must start with %s://", s, strings.Join(schemes, ":// or "))
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%q has no host", s)
+	}
+	return nil
+}
+
+// validatePort accepts an empty string since every port setting is optional
+func validatePort(s string) error {
+	if s == "" {
+		return nil
+	}
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("%q is not a valid port", s)
+	}
+	return nil
+}
+
+func authHeaders(token string) map[string]string {
+	headers := make(map[string]string)
+	if len(token) > 0 {
+		headers["Content-Type"] = "application/json"
+		headers["Authorization"] = fmt.Sprintf("Token %s", token)
+	}
+	return headers
+}
+
+func newRestyClient(ac *rmm.AgentConfig, headers map[string]string, debug bool) *resty.Client {
+	restyC := resty.New()
+	restyC.SetBaseURL(ac.BaseURL)
+	restyC.SetCloseConnection(true)
+	restyC.SetHeaders(headers)
+	restyC.SetTimeout(15 * time.Second)
+	restyC.SetDebug(debug)
+	if ac.Insecure == "true" {
+		insecureConf := &tls.Config{
+			InsecureSkipVerify: true,
+		}
+		restyC.SetTLSClientConfig(insecureConf)
+	}
+
+	if len(ac.Proxy) > 0 {
+		restyC.SetProxy(ac.Proxy)
+	}
+	if len(ac.Cert) > 0 {
+		restyC.SetRootCertificate(ac.Cert)
+	}
+	return restyC
+}
+
+// natsSettings are the values setupNatsOptions and nats.Connect use that come from the agent config
+type natsSettings struct {
+	server        string
+	proxyPath     string
+	proxyPort     string
+	pingInterval  int
+	wsCompression bool
+}
+
+func newNatsSettings(ac *rmm.AgentConfig) natsSettings {
+	var ns natsSettings
+	if ac.NatsProxyPath == "" {
+		ns.proxyPath = "natsws"
+	}
+
+	if ac.NatsProxyPort == "" {
+		ns.proxyPort = "443"
+	}
+
+	// check if using nats standard tcp, otherwise use nats websockets by default
+	if ac.NatsStandardPort != "" {
+		ns.server = fmt.Sprintf("tls://%s:%s", ac.APIURL, ac.NatsStandardPort)
+	} else {
+		ns.server = fmt.Sprintf("wss://%s:%s", ac.APIURL, ns.proxyPort)
+		ns.wsCompression = true
+	}
+
+	if ac.NatsPingInterval == 0 {
+		ns.pingInterval = randRange(35, 45)
+	} else {
+		ns.pingInterval = ac.NatsPingInterval
+	}
+	return ns
+}
@@ -0,0 +1,267 @@
+/*
+Copyright 2023 AmidaWare Inc.
+
+Licensed under the Tactical RMM License Version 1.0 (the “License”).
+You may only use the Licensed Software in accordance with the License.
+A copy of the License is available at:
+
+https://license.tacticalrmm.com
+
+*/
+
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	rmm "github.com/amidaware/rmmagent/shared"
+)
+
+const redacted = "********"
+
+// configKeys are the agent settings the config mode knows about, reg is the registry value name on windows
+var configKeys = []struct {
+	key     string
+	reg     string
+	winOnly bool
+}{
+	{key: "baseurl", reg: "BaseURL"},
+	{key: "agentid", reg: "AgentID"},
+	{key: "apiurl", reg: "ApiURL"},
+	{key: "token", reg: "Token"},
+	{key: "agentpk", reg: "AgentPK"},
+	{key: "cert", reg: "Cert"},
+	{key: "proxy", reg: "Proxy"},
+	{key: "meshdir", reg: "MeshDir"},
+	{key: "wintmpdir", reg: "WinTmpDir", winOnly: true},
+	{key: "winrunasusertmpdir", reg: "WinRunAsUserTmpDir", winOnly: true},
+	{key: "natsproxypath", reg: "NatsProxyPath"},
+	{key: "natsproxyport", reg: "NatsProxyPort"},
+	{key: "natsstandardport", reg: "NatsStandardPort"},
+	{key: "natspinginterval", reg: "NatsPingInterval"},
+	{key: "insecure", reg: "Insecure"},
+	{key: "rpcworkers", reg: "RPCWorkers"},
+	{key: "rpcqueuesize", reg: "RPCQueueSize"},
+	{key: "rpccontrolworkers", reg: "RPCControlWorkers"},
+	{key: "rpccontrolqueue", reg: "RPCControlQueue"},
+}
+
+// configRegName returns the registry value name of key, or "" if key is not a setting on this platform
+func configRegName(key string) string {
+	for _, k := range configKeys {
+		if k.key == key && (!k.winOnly || runtime.GOOS == "windows") {
+			return k.reg
+		}
+	}
+	return ""
+}
+
+func configValue(ac *rmm.AgentConfig, key string) string {
+	switch key {
+	case "baseurl":
+		return ac.BaseURL
+	case "agentid":
+		return ac.AgentID
+	case "apiurl":
+		return ac.APIURL
+	case "token":
+		if ac.Token == "" {
+			return ""
+		}
+		return redacted
+	case "agentpk":
+		return ac.AgentPK
+	case "cert":
+		return ac.Cert
+	case "proxy":
+		return ac.Proxy
+	case "meshdir":
+		return ac.CustomMeshDir
+	case "wintmpdir":
+		return ac.WinTmpDir
+	case "winrunasusertmpdir":
+		return ac.WinRunAsUserTmpDir
+	case "natsproxypath":
+		return ac.NatsProxyPath
+	case "natsproxyport":
+		return ac.NatsProxyPort
+	case "natsstandardport":
+		return ac.NatsStandardPort
+	case "natspinginterval":
+		return strconv.Itoa(ac.NatsPingInterval)
+	case "insecure":
+		return ac.Insecure
+	case "rpcworkers":
+		return strconv.Itoa(ac.RPCWorkers)
+	case "rpcqueuesize":
+		return strconv.Itoa(ac.RPCQueueSize)
+	case "rpccontrolworkers":
+		return strconv.Itoa(ac.RPCControlWorkers)
+	case "rpccontrolqueue":
+		return strconv.Itoa(ac.RPCControlQueue)
+	}
+	return ""
+}
+
+func setConfigValue(ac *rmm.AgentConfig, key, value string) error {
+	atoi := func(dst *int) error {
+		if value == "" {
+			*dst = 0
+			return nil
+		}
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s must be a number, got %q", key, value)
+		}
+		*dst = i
+		return nil
+	}
+
+	switch key {
+	case "baseurl":
+		ac.BaseURL = value
+	case "agentid":
+		ac.AgentID = value
+	case "apiurl":
+		ac.APIURL = value
+	case "token":
+		ac.Token = value
+	case "agentpk":
+		ac.AgentPK = value
+		ac.PK, _ = strconv.Atoi(value)
+	case "cert":
+		ac.Cert = value
+	case "proxy":
+		ac.Proxy = value
+	case "meshdir":
+		ac.CustomMeshDir = value
+	case "wintmpdir":
+		ac.WinTmpDir = value
+	case "winrunasusertmpdir":
+		ac.WinRunAsUserTmpDir = value
+	case "natsproxypath":
+		ac.NatsProxyPath = value
+	case "natsproxyport":
+		ac.NatsProxyPort = value
+	case "natsstandardport":
+		ac.NatsStandardPort = value
+	case "natspinginterval":
+		return atoi(&ac.NatsPingInterval)
+	case "insecure":
+		ac.Insecure = value
+	case "rpcworkers":
+		return atoi(&ac.RPCWorkers)
+	case "rpcqueuesize":
+		return atoi(&ac.RPCQueueSize)
+	case "rpccontrolworkers":
+		return atoi(&ac.RPCControlWorkers)
+	case "rpccontrolqueue":
+		return atoi(&ac.RPCControlQueue)
+	default:
+		return fmt.Errorf("unknown key %q", key)
+	}
+	return nil
+}
+
+const configUsage = `usage:
+  -m config show                   print the agent config, the token is redacted
+  -m config get <key>              print one setting
+  -m config set <key> <value> ...  change one or more settings, the result is validated before it is saved
+  -m config validate               check the agent config, exits 1 if it is invalid
+  -m config sources                list where the config was read from, later sources override earlier ones`
+
+// ConfigCLI runs the config mode and returns the exit code
+func ConfigCLI(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, configUsage)
+		return 2
+	}
+
+	ac := NewAgentConfig()
+
+	switch args[0] {
+	case "show":
+		ret := make(map[string]string)
+		for _, k := range configKeys {
+			if configRegName(k.key) != "" {
+				ret[k.key] = configValue(ac, k.key)
+			}
+		}
+		b, _ := json.MarshalIndent(ret, "", "  ")
+		fmt.Println(string(b))
+	case "get":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, configUsage)
+			return 2
+		}
+		if configRegName(args[1]) == "" {
+			fmt.Fprintf(os.Stderr, "unknown key %q\n", args[1])
+			return 1
+		}
+		fmt.Println(configValue(ac, args[1]))
+	case "set":
+		if len(args) < 3 || len(args)%2 != 1 {
+			fmt.Fprintln(os.Stderr, configUsage)
+			return 2
+		}
+		values := make(map[string]string)
+		for i := 1; i < len(args); i += 2 {
+			key, value := strings.ToLower(args[i]), args[i+1]
+			if configRegName(key) == "" {
+				fmt.Fprintf(os.Stderr, "unknown key %q\n", key)
+				return 1
+			}
+			if err := setConfigValue(ac, key, value); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			values[key] = value
+		}
+		if err := ValidateAgentConfig(ac); err != nil {
+			fmt.Fprintf(os.Stderr, "not saved, the config would be invalid:\n%s\n", err)
+			return 1
+		}
+		if err := saveAgentConfig(values); err != nil {
+			fmt.Fprintln(os.Stderr, "saving config:", err)
+			return 1
+		}
+		// set only writes the main config, warn when a drop-in or the environment still wins
+		saved := NewAgentConfig()
+		for key, value := range values {
+			if key != "token" && configValue(saved, key) != configValue(ac, key) {
+				fmt.Fprintf(os.Stderr, "warning: %s=%q is overridden by another config source, see -m config sources\n", key, value)
+			}
+		}
+		fmt.Println("saved, reload or restart the agent service to apply")
+	case "validate":
+		_, srcErrs := ConfigSources()
+		err := ValidateAgentConfig(ac)
+		for _, e := range srcErrs {
+			fmt.Println(e)
+		}
+		if err != nil {
+			fmt.Println(err)
+		}
+		if err != nil || len(srcErrs) > 0 {
+			return 1
+		}
+		fmt.Println("ok")
+	case "sources":
+		sources, srcErrs := ConfigSources()
+		for _, src := range sources {
+			fmt.Println(src)
+		}
+		for _, e := range srcErrs {
+			fmt.Fprintln(os.Stderr, "error:", e)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, configUsage)
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2023 AmidaWare Inc.
+
+Licensed under the Tactical RMM License Version 1.0 (the “License”).
+You may only use the Licensed Software in accordance with the License.
+A copy of the License is available at:
+
+https://license.tacticalrmm.com
+
+*/
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	rmm "github.com/amidaware/rmmagent/shared"
+	"github.com/go-resty/resty/v2"
+)
+
+func (a *Agent) SendDNSCheckResult(payload rmm.DNSCheckResponse, r *resty.Client) {
+	a.SendResult(r, http.MethodPatch, "/api/v3/checkrunner/", payload, checkResultTTL)
+}
+
+// DNSCheck resolves data.DNSName with the system resolver or data.DNSServer if set.
+// It fails if the name does not resolve, the answers are not exactly data.ExpectedAnswers,
+// an answer does not match data.ExpectedRegex or the lookup is slower than data.MaxLatency.
+func (a *Agent) DNSCheck(data rmm.Check) (payload rmm.DNSCheckResponse) {
+	payload.ID = data.CheckPK
+	payload.AgentID = a.AgentID
+	payload.Status = "failing"
+	payload.Answers = []string{}
+
+	recordType := strings.ToUpper(data.RecordType)
+	if recordType == "" {
+		recordType = "A"
+	}
+	if data.DNSName == "" {
+		payload.MoreInfo = "No name to resolve"
+		return
+	}
+
+	var answerRe *regexp.Regexp
+	if data.ExpectedRegex != "" {
+		var err error
+		answerRe, err = regexp.Compile(data.ExpectedRegex)
+		if err != nil {
+			payload.MoreInfo = fmt.Sprintf("Invalid expected regex: %v", err)
+			return
+		}
+	}
+
+	resolver := net.DefaultResolver
+	server := "the system resolver"
+	if data.DNSServer != "" {
+		server = data.DNSServer
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout(data))
+	defer cancel()
+
+	start := time.Now()
+	answers, err := lookupRecords(ctx, resolver, recordType, data.DNSName)
+	elapsed := time.Since(start)
+	payload.ResponseTime = elapsed.Milliseconds()
+
+	query := fmt.Sprintf("%s %s via %s", recordType, data.DNSName, server)
+	if err != nil {
+		a.Logger.Debugln("DNSCheck:", err)
+		payload.MoreInfo = fmt.Sprintf("%s failed in %dms: %s", query, payload.ResponseTime, dnsErrorReason(err))
+		return
+	}
+	sort.Strings(answers)
+	payload.Answers = answers
+	payload.MoreInfo = fmt.Sprintf("%s in %dms: %s", query, payload.ResponseTime, strings.Join(answers, ", "))
+
+	problems := make([]string, 0)
+	if len(answers) == 0 {
+		problems = append(problems, "no answers")
+	}
+	if len(data.ExpectedAnswers) > 0 {
+		expected := make([]string, 0, len(data.ExpectedAnswers))
+		for _, e := range data.ExpectedAnswers {
+			if recordType == "TXT" {
+				expected = append(expected, e)
+			} else {
+				expected = append(expected, normalizeAnswer(e))
+			}
+		}
+		sort.Strings(expected)
+		if strings.Join(expected, "\n") != strings.Join(answers, "\n") {
+			problems = append(problems, fmt.Sprintf("expected %s", strings.Join(expected, ", ")))
+		}
+	}
+	if answerRe != nil {
+		for _, ans := range answers {
+			if !answerRe.MatchString(ans) {
+				problems = append(problems, fmt.Sprintf("%s does not match %q", ans, data.ExpectedRegex))
+			}
+		}
+	}
+	if p := overLatency(data, elapsed); p != "" {
+		problems = append(problems, p)
+	}
+
+	if len(problems) > 0 {
+		payload.MoreInfo += "\n" + strings.Join(problems, "\n")
+		return
+	}
+	payload.Status = "passing"
+	return
+}
+
+// lookupRecords returns the answers as text, MX as "pref host" and SRV as "priority weight port target"
+func lookupRecords(ctx context.Context, r *net.Resolver, recordType, name string) ([]string, error) {
+	ret := make([]string, 0)
+	switch recordType {
+	case "A", "AAAA":
+		network := "ip4"
+		if recordType == "AAAA" {
+			network = "ip6"
+		}
+		ips, err := r.LookupIP(ctx, network, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			ret = append(ret, ip.String())
+		}
+	case "CNAME":
+		cname, err := r.LookupCNAME(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		// the query name comes back when the name resolves but is not an alias
+		if normalizeAnswer(cname) == normalizeAnswer(name) {
+			return nil, fmt.Errorf("%s has no CNAME record", name)
+		}
+		ret = append(ret, normalizeAnswer(cname))
+	case "MX":
+		mxs, err := r.LookupMX(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, mx := range mxs {
+			ret = append(ret, fmt.Sprintf("%d %s", mx.Pref, normalizeAnswer(mx.Host)))
+		}
+	case "TXT":
+		txts, err := r.LookupTXT(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, txts...)
+	case "SRV":
+		_, srvs, err := r.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			return nil, err
+		}
+		for _, srv := range srvs {
+			ret = append(ret, fmt.Sprintf("%d %d %d %s", srv.Priority, srv.Weight, srv.Port, normalizeAnswer(srv.Target)))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported record type %s, use A, AAAA, CNAME, MX, TXT or SRV", recordType)
+	}
+	return ret, nil
+}
+
+// normalizeAnswer lowercases host names and removes the trailing dot so they compare with what people type
+func normalizeAnswer(s string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), ".")
+}
+
+func dnsErrorReason(err error) string {
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) {
+		return err.Error()
+	}
+	switch {
+	case dnsErr.IsNotFound:
+		return "NXDOMAIN, the name does not exist or has no records of this type"
+	case dnsErr.IsTimeout:
+		return "timed out"
+	// the go resolver reports SERVFAIL as server misbehaving
+	case strings.Contains(dnsErr.Err, "server misbehaving"):
+		return "SERVFAIL, the server could not answer"
+	}
+	return dnsErr.Error()
+}
@@ -0,0 +1,341 @@
+/*
+Copyright 2023 AmidaWare Inc.
+
+Licensed under the Tactical RMM License Version 1.0 (the “License”).
+You may only use the Licensed Software in accordance with the License.
+A copy of the License is available at:
+
+https://license.tacticalrmm.com
+
+*/
+
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+	"github.com/shirou/gopsutil/v3/disk"
+	trmm "github.com/wh1te909/trmm-shared"
+)
+
+const (
+	doctorPass = "pass"
+	doctorWarn = "warn"
+	doctorFail = "fail"
+	doctorSkip = "skip"
+
+	doctorTimeout      = 10 * time.Second
+	doctorMaxClockSkew = time.Minute
+	doctorMinFreeDisk  = 200 * 1024 * 1024
+	doctorLowFreeDisk  = 1024 * 1024 * 1024
+)
+
+type DoctorCheck struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Detail   string `json:"detail"`
+	Duration int64  `json:"duration_ms"`
+}
+
+// DoctorReport is the result of the diagnostics run by -m doctor and the doctor rpc
+type DoctorReport struct {
+	AgentID string        `json:"agent_id"`
+	Version string        `json:"version"`
+	Time    time.Time     `json:"time"`
+	Passed  bool          `json:"passed"`
+	Checks  []DoctorCheck `json:"checks"`
+}
+
+// RunDoctor checks everything the agent needs to reach the rmm, a failed check does not stop the ones after it
+func (a *Agent) RunDoctor() DoctorReport {
+	ret := DoctorReport{
+		AgentID: a.AgentID,
+		Version: a.Version,
+		Time:    time.Now(),
+		Passed:  true,
+		Checks:  []DoctorCheck{},
+	}
+
+	run := func(name string, fn func() (string, string)) {
+		start := time.Now()
+		status, detail := fn()
+		ret.Checks = append(ret.Checks, DoctorCheck{
+			Name:     name,
+			Status:   status,
+			Detail:   detail,
+			Duration: time.Since(start).Milliseconds(),
+		})
+		if status == doctorFail {
+			ret.Passed = false
+		}
+	}
+
+	s := a.settings()
+	apiHost, apiAddr := hostPort(s.BaseURL)
+	natsHost, natsAddr := hostPort(s.NatsServer)
+
+	run("config", a.doctorConfig)
+	run("dns", func() (string, string) { return doctorDNS(s.ApiURL) })
+	run("api tcp", func() (string, string) {
+		status, detail := doctorTCP(apiAddr)
+		// a direct connection is not needed when the api is reached through a proxy
+		if status == doctorFail && s.Proxy != "" {
+			status = doctorWarn
+		}
+		return status, detail
+	})
+	run("api tls", func() (string, string) {
+		if !strings.HasPrefix(s.BaseURL, "https://") {
+			return doctorSkip, "the api is not using https"
+		}
+		return a.doctorTLS(apiAddr, apiHost)
+	})
+	run("proxy", a.doctorProxy)
+
+	var serverDate string
+	run("api auth", func() (string, string) {
+		var status, detail string
+		status, detail, serverDate = a.doctorAPIAuth()
+		return status, detail
+	})
+	run("clock skew", func() (string, string) { return doctorClockSkew(serverDate) })
+
+	run("nats tcp", func() (string, string) { return doctorTCP(natsAddr) })
+	run("nats tls", func() (string, string) {
+		// standard nats upgrades to tls after the plain text INFO, that is covered by the connect check
+		if !strings.HasPrefix(s.NatsServer, "wss://") {
+			return doctorSkip, "tls is negotiated by the nats protocol"
+		}
+		return a.doctorTLS(natsAddr, natsHost)
+	})
+	run("nats connect", a.doctorNats)
+
+	run("mesh agent", func() (string, string) {
+		if trmm.FileExists(a.MeshSystemEXE) {
+			return doctorPass, a.MeshSystemEXE
+		}
+		return doctorWarn, a.MeshSystemEXE + " not found, remote background and take control will not work"
+	})
+	run("log file", doctorLogFile)
+	run("disk space", doctorDisk)
+
+	return ret
+}
+
+// hostPort returns the host and host:port of u, using the default port of the scheme if none is set
+func hostPort(u string) (string, string) {
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.Host == "" {
+		return "", ""
+	}
+	port := parsed.Port()
+	if port == "" {
+		switch parsed.Scheme {
+		case "http", "ws":
+			port = "80"
+		case "nats", "tls":
+			port = "4222"
+		default:
+			port = "443"
+		}
+	}
+	return parsed.Hostname(), net.JoinHostPort(parsed.Hostname(), port)
+}
+
+func (a *Agent) doctorConfig() (string, string) {
+	ac := NewAgentConfig()
+	sources, srcErrs := ConfigSources()
+	errs := append(srcErrs, ValidateAgentConfig(ac))
+	if err := errors.Join(errs...); err != nil {
+		return doctorFail, strings.ReplaceAll(err.Error(), "\n", "; ")
+	}
+	return doctorPass, "read from " + strings.Join(sources, ", ")
+}
+
+func doctorDNS(host string) (string, string) {
+	if host == "" {
+		return doctorFail, "no api url configured"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return doctorFail, err.Error()
+	}
+	return doctorPass, fmt.Sprintf("%s resolves to %s", host, strings.Join(addrs, ", "))
+}
+
+func doctorTCP(addr string) (string, string) {
+	if addr == "" {
+		return doctorFail, "no address configured"
+	}
+	if err := TestTCP(addr, doctorTimeout); err != nil {
+		return doctorFail, err.Error()
+	}
+	return doctorPass, "connected to " + addr
+}
+
+func (a *Agent) doctorTLS(addr, serverName string) (string, string) {
+	if addr == "" {
+		return doctorFail, "no address configured"
+	}
+	s := a.settings()
+	conf := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: s.Insecure,
+	}
+	if s.Cert != "" {
+		pem, err := os.ReadFile(s.Cert)
+		if err != nil {
+			return doctorFail, err.Error()
+		}
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(pem)
+		conf.RootCAs = pool
+	}
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: doctorTimeout}, "tcp", addr, conf)
+	if err != nil {
+		return doctorFail, err.Error()
+	}
+	defer conn.Close()
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return doctorFail, "no certificate presented"
+	}
+	days := int(time.Until(certs[0].NotAfter).Hours() / 24)
+	detail := fmt.Sprintf("%s, certificate expires %s (%d days)", certs[0].Subject.CommonName, certs[0].NotAfter.Format(time.RFC3339), days)
+	if s.Insecure {
+		return doctorWarn, detail + ", verification is disabled"
+	}
+	if days < 14 {
+		return doctorWarn, detail
+	}
+	return doctorPass, detail
+}
+
+func (a *Agent) doctorProxy() (string, string) {
+	proxy := a.settings().Proxy
+	if proxy == "" {
+		return doctorSkip, "no proxy configured"
+	}
+	_, addr := hostPort(proxy)
+	return doctorTCP(addr)
+}
+
+// doctorAPIAuth does an authenticated request and returns the server's Date header for the clock check
+func (a *Agent) doctorAPIAuth() (string, string, string) {
+	endpoint := fmt.Sprintf("/api/v3/%s/config/", a.AgentID)
+	r, err := a.restClient().R().Get(endpoint)
+	if err != nil {
+		return doctorFail, err.Error(), ""
+	}
+	date := r.Header().Get("Date")
+	switch r.StatusCode() {
+	case http.StatusOK:
+		return doctorPass, fmt.Sprintf("%s in %v", r.Status(), r.Time().Round(time.Millisecond)), date
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return doctorFail, r.Status() + ", the agent token was rejected", date
+	}
+	return doctorFail, r.Status(), date
+}
+
+func doctorClockSkew(serverDate string) (string, string) {
+	if serverDate == "" {
+		return doctorSkip, "the api did not respond with a date"
+	}
+	t, err := http.ParseTime(serverDate)
+	if err != nil {
+		return doctorSkip, err.Error()
+	}
+	skew := time.Since(t).Round(time.Second)
+	detail := fmt.Sprintf("local clock is %v off the server", skew)
+	if skew.Abs() > doctorMaxClockSkew {
+		return doctorFail, detail
+	}
+	return doctorPass, detail
+}
+
+func (a *Agent) doctorNats() (string, string) {
+	opts := a.setupNatsOptions()
+	// fail instead of retrying in the background so the result is known when Connect returns
+	opts = append(opts, nats.RetryOnFailedConnect(false), nats.Timeout(doctorTimeout))
+	nc, err := nats.Connect(a.settings().NatsServer, opts...)
+	if err != nil {
+		return doctorFail, err.Error()
+	}
+	defer nc.Close()
+
+	rtt, err := nc.RTT()
+	if err != nil {
+		return doctorFail, err.Error()
+	}
+	return doctorPass, fmt.Sprintf("connected to %s, round trip %v", nc.ConnectedUrlRedacted(), rtt.Round(time.Millisecond))
+}
+
+func doctorLogFile() (string, string) {
+	path := LogFilePath()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
+	if err != nil {
+		return doctorFail, err.Error()
+	}
+	f.Close()
+	return doctorPass, path + " is writable"
+}
+
+func doctorDisk() (string, string) {
+	dir := agentStateDir()
+	for !trmm.FileExists(dir) && filepath.Dir(dir) != dir {
+		dir = filepath.Dir(dir)
+	}
+	usage, err := disk.Usage(dir)
+	if err != nil {
+		return doctorFail, err.Error()
+	}
+	detail := fmt.Sprintf("%s free on %s", ByteCountSI(usage.Free), dir)
+	switch {
+	case usage.Free < doctorMinFreeDisk:
+		return doctorFail, detail
+	case usage.Free < doctorLowFreeDisk:
+		return doctorWarn, detail
+	}
+	return doctorPass, detail
+}
+
+// Doctor prints the diagnostics report and returns the exit code
+func (a *Agent) Doctor(jsonOut bool) int {
+	report := a.RunDoctor()
+
+	if jsonOut {
+		b, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(b))
+	} else {
+		for _, c := range report.Checks {
+			fmt.Printf("[%s] %-13s %s\n", strings.ToUpper(c.Status), c.Name, c.Detail)
+		}
+		if report.Passed {
+			fmt.Println("\nAll checks passed")
+		} else {
+			fmt.Println("\nSome checks failed")
+		}
+	}
+
+	if !report.Passed {
+		return 1
+	}
+	return 0
+}
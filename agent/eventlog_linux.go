@@ -0,0 +1,324 @@
+/*
+Copyright 2023 AmidaWare Inc.
+
+Licensed under the Tactical RMM License Version 1.0 (the “License”).
+You may only use the Licensed Software in accordance with the License.
+A copy of the License is available at:
+
+https://license.tacticalrmm.com
+
+*/
+
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	rmm "github.com/amidaware/rmmagent/shared"
+)
+
+const (
+	// the journal can hold millions of entries, cap the amount sent back to the rmm
+	maxEventLogEntries = 20000
+	journalctlTimeout  = 120
+	// syslog files are read from the end in blocks of this size
+	syslogReadBlock = 64 * 1024
+)
+
+var (
+	syslogFiles    = []string{"/var/log/syslog", "/var/log/messages"}
+	authlogFiles   = []string{"/var/log/auth.log", "/var/log/secure"}
+	rfc3164Regex   = regexp.MustCompile(`^([A-Z][a-z]{2} [ \d]\d \d{2}:\d{2}:\d{2}) \S+ ([^:\[\s]+)(?:\[(\d+)\])?: (.*)$`)
+	isoSyslogRegex = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2}T\S+) \S+ ([^:\[\s]+)(?:\[(\d+)\])?: (.*)$`)
+	syslogPriRegex = regexp.MustCompile(`^<(\d{1,3})>`)
+	// a level tag like "<err>", "[ERROR]" or "warning:" at the start of the message
+	syslogLevelTagRegex = regexp.MustCompile(`(?i)^[<\[(]?(emerg|alert|crit|critical|fatal|err|error|warn|warning|notice|info|debug)[>\]):]`)
+	syslogLevels        = map[string]int{
+		"emerg": 0, "alert": 1, "crit": 2, "critical": 2, "fatal": 2, "err": 3, "error": 3,
+		"warn": 4, "warning": 4, "notice": 5, "info": 6, "debug": 7,
+	}
+)
+
+// journalEntry holds the fields we need from journalctl -o json
+// MESSAGE is an array of bytes instead of a string when it is not valid utf-8
+type journalEntry struct {
+	RealtimeTimestamp string          `json:"__REALTIME_TIMESTAMP"`
+	Priority          string          `json:"PRIORITY"`
+	SyslogIdentifier  string          `json:"SYSLOG_IDENTIFIER"`
+	SystemdUnit       string          `json:"_SYSTEMD_UNIT"`
+	Comm              string          `json:"_COMM"`
+	Message           json.RawMessage `json:"MESSAGE"`
+}
+
+func (e journalEntry) message() string {
+	var s string
+	if err := json.Unmarshal(e.Message, &s); err == nil {
+		return s
+	}
+	var b []byte
+	var ints []int
+	if err := json.Unmarshal(e.Message, &ints); err == nil {
+		for _, i := range ints {
+			b = append(b, byte(i))
+		}
+	}
+	return string(b)
+}
+
+func (e journalEntry) source() string {
+	switch {
+	case e.SystemdUnit != "":
+		return e.SystemdUnit
+	case e.SyslogIdentifier != "":
+		return e.SyslogIdentifier
+	default:
+		return e.Comm
+	}
+}
+
+// syslogPriorityType maps syslog priorities (0 emerg - 7 debug) to windows event types
+func syslogPriorityType(priority int) string {
+	switch {
+	case priority <= 3:
+		return "ERROR"
+	case priority == 4:
+		return "WARNING"
+	default:
+		return "INFO"
+	}
+}
+
+// journalMatches translates the windows log names sent by the rmm into journalctl filters
+// Security -> auth/authpriv facilities, System/Application -> the whole system journal,
+// anything else is treated as a systemd unit if it has a suffix, otherwise as a syslog identifier
+func journalMatches(logName string) []string {
+	switch strings.ToLower(logName) {
+	case "", "system", "application":
+		return []string{"--system"}
+	case "security":
+		return []string{"SYSLOG_FACILITY=4", "SYSLOG_FACILITY=10"}
+	}
+	if strings.Contains(logName, ".") {
+		return []string{"-u", logName}
+	}
+	return []string{"-t", logName}
+}
+
+func (a *Agent) GetEventLog(logName string, searchLastDays int) []rmm.EventLogMsg {
+	if _, err := exec.LookPath("journalctl"); err == nil && systemdBooted() {
+		ret, err := a.journalEventLog(logName, searchLastDays)
+		if err == nil {
+			return ret
+		}
+		a.Logger.Debugln("GetEventLog() journalctl:", err)
+	}
+	return a.syslogEventLog(logName, searchLastDays)
+}
+
+func (a *Agent) journalEventLog(logName string, searchLastDays int) ([]rmm.EventLogMsg, error) {
+	ret := make([]rmm.EventLogMsg, 0)
+
+	args := []string{"-o", "json", "--no-pager", "-r", "-n", strconv.Itoa(maxEventLogEntries)}
+	if searchLastDays != 0 {
+		startTime := time.Now().Add(-time.Duration(searchLastDays) * 24 * time.Hour)
+		args = append(args, "--since", startTime.Format("2006-01-02 15:04:05"))
+	}
+	args = append(args, journalMatches(logName)...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), journalctlTimeout*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "journalctl", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return ret, err
+	}
+	if err := cmd.Start(); err != nil {
+		return ret, err
+	}
+
+	uid := 0
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+
+		usec, _ := strconv.ParseInt(entry.RealtimeTimestamp, 10, 64)
+		priority, err := strconv.Atoi(entry.Priority)
+		if err != nil {
+			priority = 6
+		}
+
+		uid++
+		ret = append(ret, rmm.EventLogMsg{
+			Source:    CleanString(entry.source()),
+			EventType: syslogPriorityType(priority),
+			EventID:   uint32(priority), // there are no event ids on linux, expose the priority so checks can match on it
+			Message:   CleanString(entry.message()),
+			Time:      time.UnixMicro(usec).String(),
+			UID:       uid,
+		})
+	}
+
+	if err := cmd.Wait(); err != nil && len(ret) == 0 {
+		return ret, err
+	}
+	return ret, nil
+}
+
+// syslogLinePriority returns the priority of a plain text syslog line, 6 (info) when it is not logged.
+// The <PRI> prefix is only written by some templates, otherwise a level tag at the start of the message is used.
+func syslogLinePriority(pri, msg string) int {
+	if pri != "" {
+		if p, err := strconv.Atoi(pri); err == nil {
+			return p & 7
+		}
+	}
+	if m := syslogLevelTagRegex.FindStringSubmatch(msg); m != nil {
+		return syslogLevels[strings.ToLower(m[1])]
+	}
+	return 6
+}
+
+// parseSyslogLine parses both the traditional rsyslog format and the high precision format used by debian 12+
+func parseSyslogLine(line string, now time.Time) (t time.Time, pri, source, msg string, ok bool) {
+	if m := syslogPriRegex.FindStringSubmatch(line); m != nil {
+		pri = m[1]
+		line = line[len(m[0]):]
+	}
+	if m := isoSyslogRegex.FindStringSubmatch(line); m != nil {
+		var err error
+		t, err = time.Parse(time.RFC3339Nano, m[1])
+		if err != nil {
+			return t, "", "", "", false
+		}
+		return t, pri, m[2], m[4], true
+	}
+	if m := rfc3164Regex.FindStringSubmatch(line); m != nil {
+		var err error
+		t, err = time.ParseInLocation("Jan _2 15:04:05", m[1], now.Location())
+		if err != nil {
+			return t, "", "", "", false
+		}
+		// the year is not logged, entries from the future belong to last year
+		t = t.AddDate(now.Year(), 0, 0)
+		if t.After(now.Add(24 * time.Hour)) {
+			t = t.AddDate(-1, 0, 0)
+		}
+		return t, pri, m[2], m[4], true
+	}
+	return t, "", "", "", false
+}
+
+// readLinesBackward calls fn with the lines of f from the last to the first until fn returns false,
+// only syslogReadBlock bytes and the line being assembled are held in memory
+func readLinesBackward(f *os.File, fn func(line string) bool) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	pos := fi.Size()
+	buf := make([]byte, syslogReadBlock)
+	var partial []byte
+	for pos > 0 {
+		n := int64(len(buf))
+		if pos < n {
+			n = pos
+		}
+		pos -= n
+		if _, err := f.ReadAt(buf[:n], pos); err != nil {
+			return err
+		}
+		block := append(buf[:n:n], partial...)
+		for {
+			i := bytes.LastIndexByte(block, '\n')
+			if i < 0 {
+				break
+			}
+			if line := block[i+1:]; len(line) > 0 && !fn(string(line)) {
+				return nil
+			}
+			block = block[:i]
+		}
+		partial = append([]byte(nil), block...)
+	}
+	if len(partial) > 0 {
+		fn(string(partial))
+	}
+	return nil
+}
+
+func (a *Agent) syslogEventLog(logName string, searchLastDays int) []rmm.EventLogMsg {
+	ret := make([]rmm.EventLogMsg, 0)
+
+	// unit and identifier log names only return lines logged by that program
+	var ident string
+	files := syslogFiles
+	switch strings.ToLower(logName) {
+	case "", "system", "application":
+	case "security":
+		files = authlogFiles
+	default:
+		ident = strings.TrimSuffix(logName, ".service")
+	}
+
+	var fh *os.File
+	for _, f := range files {
+		var err error
+		fh, err = os.Open(f)
+		if err == nil {
+			break
+		}
+		a.Logger.Debugln("GetEventLog()", err)
+	}
+	if fh == nil {
+		return ret
+	}
+	defer fh.Close()
+
+	now := time.Now()
+	startTime := now.Add(-time.Duration(searchLastDays) * 24 * time.Hour)
+	uid := 0
+
+	// newest first, same as the windows event log
+	err := readLinesBackward(fh, func(line string) bool {
+		t, pri, source, msg, ok := parseSyslogLine(line, now)
+		if !ok {
+			return true
+		}
+		if searchLastDays != 0 && t.Before(startTime) {
+			return false
+		}
+		if ident != "" && source != ident {
+			return true
+		}
+
+		priority := syslogLinePriority(pri, msg)
+		uid++
+		ret = append(ret, rmm.EventLogMsg{
+			Source:    CleanString(source),
+			EventType: syslogPriorityType(priority),
+			EventID:   uint32(priority),
+			Message:   CleanString(msg),
+			Time:      t.String(),
+			UID:       uid,
+		})
+		return uid < maxEventLogEntries
+	})
+	if err != nil {
+		a.Logger.Debugln("GetEventLog()", err)
+	}
+	return ret
+}
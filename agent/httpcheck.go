@@ -0,0 +1,147 @@
+/*
+Copyright 2023 AmidaWare Inc.
+
+Licensed under the Tactical RMM License Version 1.0 (the “License”).
+You may only use the Licensed Software in accordance with the License.
+A copy of the License is available at:
+
+https://license.tacticalrmm.com
+
+*/
+
+package agent
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	rmm "github.com/amidaware/rmmagent/shared"
+	"github.com/go-resty/resty/v2"
+)
+
+const (
+	// used when the check does not set a timeout
+	defaultNetCheckTimeout = 10
+	// only this much of the response is searched by the body regex
+	httpCheckMaxBody = 1024 * 1024
+)
+
+// checkTimeout returns the timeout of a network check, data.Timeout is in seconds
+func checkTimeout(data rmm.Check) time.Duration {
+	if data.Timeout <= 0 {
+		return defaultNetCheckTimeout * time.Second
+	}
+	return time.Duration(data.Timeout) * time.Second
+}
+
+// overLatency returns a problem if a max latency is set and elapsed is over it
+func overLatency(data rmm.Check, elapsed time.Duration) string {
+	if data.MaxLatency <= 0 || elapsed.Milliseconds() <= int64(data.MaxLatency) {
+		return ""
+	}
+	return fmt.Sprintf("took %dms, over the %dms threshold", elapsed.Milliseconds(), data.MaxLatency)
+}
+
+func (a *Agent) SendHTTPCheckResult(payload rmm.HTTPCheckResponse, r *resty.Client) {
+	a.SendResult(r, http.MethodPatch, "/api/v3/checkrunner/", payload, checkResultTTL)
+}
+
+// HTTPCheck requests data.URL and fails on an unexpected status code, a body that does not match
+// data.BodyRegex or a response slower than data.MaxLatency.
+// Any 2xx or 3xx status passes when no status codes are set, redirects are followed.
+func (a *Agent) HTTPCheck(data rmm.Check) (payload rmm.HTTPCheckResponse) {
+	payload.ID = data.CheckPK
+	payload.AgentID = a.AgentID
+	payload.Status = "failing"
+
+	method := strings.ToUpper(data.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	var bodyRe *regexp.Regexp
+	if data.BodyRegex != "" {
+		var err error
+		bodyRe, err = regexp.Compile(data.BodyRegex)
+		if err != nil {
+			payload.MoreInfo = fmt.Sprintf("Invalid body regex: %v", err)
+			return
+		}
+	}
+
+	req, err := http.NewRequest(method, data.URL, nil)
+	if err != nil {
+		payload.MoreInfo = err.Error()
+		return
+	}
+	req.Header.Set("User-Agent", "tacticalrmm-agent/"+a.Version)
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: data.IgnoreTLSErrors}
+	client := &http.Client{Timeout: checkTimeout(data), Transport: transport}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		a.Logger.Debugln("HTTPCheck:", err)
+		payload.MoreInfo = fmt.Sprintf("%s %s failed: %v", method, data.URL, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, httpCheckMaxBody))
+	elapsed := time.Since(start)
+	payload.StatusCode = resp.StatusCode
+	payload.ResponseTime = elapsed.Milliseconds()
+
+	info := fmt.Sprintf("%s %s: %s in %dms", method, data.URL, resp.Status, payload.ResponseTime)
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		cert := resp.TLS.PeerCertificates[0]
+		days := int(time.Until(cert.NotAfter).Hours() / 24)
+		payload.CertDaysLeft = &days
+		info += fmt.Sprintf(", certificate expires %s (%d days)", cert.NotAfter.Format("2006-01-02"), days)
+	}
+
+	problems := make([]string, 0)
+	if !expectedStatus(resp.StatusCode, data.ExpectedStatusCodes) {
+		if len(data.ExpectedStatusCodes) > 0 {
+			problems = append(problems, fmt.Sprintf("status %d is not one of %v", resp.StatusCode, data.ExpectedStatusCodes))
+		} else {
+			problems = append(problems, fmt.Sprintf("status %d is not a 2xx or 3xx", resp.StatusCode))
+		}
+	}
+	switch {
+	case err != nil:
+		problems = append(problems, fmt.Sprintf("reading the body failed: %v", err))
+	case bodyRe != nil && !bodyRe.Match(body):
+		problems = append(problems, fmt.Sprintf("body does not match %q", data.BodyRegex))
+	}
+	if p := overLatency(data, elapsed); p != "" {
+		problems = append(problems, p)
+	}
+
+	payload.MoreInfo = info
+	if len(problems) > 0 {
+		payload.MoreInfo += "\n" + strings.Join(problems, "\n")
+		return
+	}
+	payload.Status = "passing"
+	return
+}
+
+func expectedStatus(code int, expected []int) bool {
+	if len(expected) == 0 {
+		return code >= 200 && code < 400
+	}
+	for _, c := range expected {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2023 AmidaWare Inc.
+
+Licensed under the Tactical RMM License Version 1.0 (the “License”).
+You may only use the Licensed Software in accordance with the License.
+A copy of the License is available at:
+
+https://license.tacticalrmm.com
+
+*/
+
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// JobRequester identifies the rpc that started a job, nil for commands the agent runs for itself
+type JobRequester struct {
+	Func  string
+	MsgID int
+	// Output is optional and receives every line of stdout/stderr while the process runs
+	Output func(stream, line string)
+}
+
+// Job is a process started by an rpc through CmdV2, runScript or cmdShell that is still running
+type Job struct {
+	ID        int       `json:"id"`
+	Func      string    `json:"func"`
+	MsgID     int       `json:"msg_id"`
+	Command   string    `json:"command"`
+	PID       int       `json:"pid"`
+	Started   time.Time `json:"started"`
+	Cancelled bool      `json:"cancelled"`
+}
+
+type jobEntry struct {
+	job Job
+	// pid is resolved lazily since the process may still be starting when the job is registered
+	pid func() int
+}
+
+type jobRegistry struct {
+	sync.Mutex
+	lastID int
+	jobs   map[int]*jobEntry
+}
+
+var runningJobs = &jobRegistry{jobs: make(map[int]*jobEntry)}
+
+// add registers a job started by an rpc and returns its id. Commands the agent runs for itself,
+// req is nil, are not registered so they cannot be listed or cancelled, their id is 0.
+func (r *jobRegistry) add(req *JobRequester, command string, pid func() int) int {
+	if req == nil {
+		return 0
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.lastID++
+	j := Job{
+		ID:      r.lastID,
+		Func:    req.Func,
+		MsgID:   req.MsgID,
+		Command: command,
+		Started: time.Now(),
+	}
+	r.jobs[j.ID] = &jobEntry{job: j, pid: pid}
+	return j.ID
+}
+
+// remove unregisters the job and reports whether it was cancelled
+func (r *jobRegistry) remove(id int) bool {
+	r.Lock()
+	defer r.Unlock()
+	e, ok := r.jobs[id]
+	if !ok {
+		return false
+	}
+	delete(r.jobs, id)
+	return e.job.Cancelled
+}
+
+func (r *jobRegistry) List() []Job {
+	r.Lock()
+	defer r.Unlock()
+	ret := make([]Job, 0, len(r.jobs))
+	for _, e := range r.jobs {
+		j := e.job
+		j.PID = e.pid()
+		ret = append(ret, j)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return ret
+}
+
+// Cancel kills the process group of the job, the function that started it returns as usual
+func (r *jobRegistry) Cancel(id int) error {
+	r.Lock()
+	e, ok := r.jobs[id]
+	if !ok {
+		r.Unlock()
+		return fmt.Errorf("job %d is not running", id)
+	}
+	pid := e.pid()
+	if pid == 0 {
+		r.Unlock()
+		return errors.New("job is still starting, try again")
+	}
+	e.job.Cancelled = true
+	r.Unlock()
+
+	return killProcGroup(pid)
+}
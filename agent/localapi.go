@@ -0,0 +1,326 @@
+/*
+Copyright 2023 AmidaWare Inc.
+
+Licensed under the Tactical RMM License Version 1.0 (the “License”).
+You may only use the Licensed Software in accordance with the License.
+A copy of the License is available at:
+
+https://license.tacticalrmm.com
+
+*/
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	rmm "github.com/amidaware/rmmagent/shared"
+)
+
+// localAPIURL is the base of every local api request, the host is ignored since requests go over the socket
+const localAPIURL = "http://tacticalagent"
+
+const localAPIMaxBody = 64 * 1024
+
+const localRelayTimeout = 10 * time.Second
+
+// localCheckRun is set while a check run started through the local api is still going
+var localCheckRun int32
+
+type LocalIdentity struct {
+	AgentID  string `json:"agent_id"`
+	AgentPK  int    `json:"agent_pk"`
+	Hostname string `json:"hostname"`
+	Version  string `json:"version"`
+	Platform string `json:"platform"`
+	GoArch   string `json:"goarch"`
+	BaseURL  string `json:"base_url"`
+}
+
+type localCustomFields struct {
+	Fields map[string]string `json:"fields"`
+}
+
+type localAlert struct {
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+type localNote struct {
+	Note string `json:"note"`
+}
+
+// RunLocalAPI serves the local api for scripts and tools running on the endpoint, the socket only accepts root.
+// Submissions are relayed to the rmm over the agent's nats connection, see rmm.LocalCustomFieldsNats for the contract.
+// There is no named pipe yet so it is not started on windows.
+func (a *Agent) RunLocalAPI() {
+	l, err := listenLocal()
+	if err != nil {
+		a.Logger.Errorln("RunLocalAPI():", err)
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/status", a.localHandler(http.MethodGet, func(r *http.Request) (int, interface{}) {
+		return http.StatusOK, a.Status()
+	}))
+	mux.HandleFunc("/v1/identity", a.localHandler(http.MethodGet, func(r *http.Request) (int, interface{}) {
+		return http.StatusOK, LocalIdentity{
+			AgentID:  a.AgentID,
+			AgentPK:  a.AgentPK,
+			Hostname: a.Hostname,
+			Version:  a.Version,
+			Platform: a.Platform,
+			GoArch:   a.GoArch,
+			BaseURL:  a.settings().BaseURL,
+		}
+	}))
+	mux.HandleFunc("/v1/customfields", a.localHandler(http.MethodPost, func(r *http.Request) (int, interface{}) {
+		var req localCustomFields
+		if err := decodeLocal(r, &req); err != nil {
+			return http.StatusBadRequest, err
+		}
+		if len(req.Fields) == 0 {
+			return http.StatusBadRequest, errors.New("no fields")
+		}
+		for name := range req.Fields {
+			if strings.TrimSpace(name) == "" {
+				return http.StatusBadRequest, errors.New("field names cannot be empty")
+			}
+		}
+		return a.relay("agent-customfields", rmm.LocalCustomFieldsNats{Agentid: a.AgentID, Fields: req.Fields})
+	}))
+	mux.HandleFunc("/v1/alerts", a.localHandler(http.MethodPost, func(r *http.Request) (int, interface{}) {
+		var req localAlert
+		if err := decodeLocal(r, &req); err != nil {
+			return http.StatusBadRequest, err
+		}
+		if !stringInSlice(req.Severity, []string{"info", "warning", "error"}) {
+			return http.StatusBadRequest, fmt.Errorf("severity must be info, warning or error, got %q", req.Severity)
+		}
+		if strings.TrimSpace(req.Message) == "" {
+			return http.StatusBadRequest, errors.New("message is empty")
+		}
+		return a.relay("agent-alert", rmm.LocalAlertNats{Agentid: a.AgentID, Severity: req.Severity, Message: req.Message})
+	}))
+	mux.HandleFunc("/v1/notes", a.localHandler(http.MethodPost, func(r *http.Request) (int, interface{}) {
+		var req localNote
+		if err := decodeLocal(r, &req); err != nil {
+			return http.StatusBadRequest, err
+		}
+		if strings.TrimSpace(req.Note) == "" {
+			return http.StatusBadRequest, errors.New("note is empty")
+		}
+		return a.relay("agent-note", rmm.LocalNoteNats{Agentid: a.AgentID, Note: req.Note})
+	}))
+	mux.HandleFunc("/v1/checks/run", a.localHandler(http.MethodPost, func(r *http.Request) (int, interface{}) {
+		if !atomic.CompareAndSwapInt32(&localCheckRun, 0, 1) {
+			return http.StatusConflict, errors.New("checks are already running")
+		}
+		go func() {
+			defer atomic.StoreInt32(&localCheckRun, 0)
+			a.forceRunChecks()
+		}()
+		return http.StatusAccepted, map[string]string{"status": "started"}
+	}))
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	if err := srv.Serve(l); err != nil {
+		a.Logger.Errorln("RunLocalAPI():", err)
+	}
+}
+
+// localHandler wraps fn with the method check and json encoding, an error result is sent as {"error": "..."}
+func (a *Agent) localHandler(method string, fn func(r *http.Request) (int, interface{})) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "use " + method})
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, localAPIMaxBody)
+		code, ret := fn(r)
+		if err, ok := ret.(error); ok {
+			a.Logger.Debugln("local api", r.URL.Path, err)
+			ret = map[string]string{"error": err.Error()}
+		}
+		writeJSON(w, code, ret)
+	}
+}
+
+func decodeLocal(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("invalid request: %w", err)
+	}
+	return nil
+}
+
+// relay publishes a local submission to the rmm the same way NatsMessage sends check-ins.
+// The rmm does not answer check-ins, so "published" only means the nats server has the message.
+func (a *Agent) relay(mode string, payload interface{}) (int, interface{}) {
+	nc := currentNatsConn()
+	if nc == nil || !nc.IsConnected() {
+		// nothing is buffered while reconnecting, the caller has to retry
+		return http.StatusServiceUnavailable, errors.New("not connected to the rmm, try again later")
+	}
+	if err := nc.PublishRequest(a.AgentID, mode, encodeMsgpack(payload)); err != nil {
+		return http.StatusServiceUnavailable, err
+	}
+	if err := nc.FlushTimeout(localRelayTimeout); err != nil {
+		return http.StatusServiceUnavailable, fmt.Errorf("the nats server did not confirm the message: %w", err)
+	}
+	a.Logger.Debugln("local api relayed", mode, payload)
+	return http.StatusAccepted, map[string]string{"status": "published"}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func localAPIClient() *http.Client {
+	return &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialLocal(ctx)
+			},
+		},
+	}
+}
+
+// localRequest sends a request to the running service and returns the response body,
+// a response with an error status is returned as an error
+func localRequest(method, path string, body interface{}) ([]byte, error) {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, localAPIURL+path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := localAPIClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not reach the agent service, is it running? %w", err)
+	}
+	defer resp.Body.Close()
+
+	ret, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(ret, &e) == nil && e.Error != "" {
+			return nil, errors.New(e.Error)
+		}
+		return nil, errors.New(resp.Status)
+	}
+	return ret, nil
+}
+
+// LocalStatus asks the running service for its status, prints it and returns the exit code
+func LocalStatus(jsonOut bool) int {
+	b, err := localRequest(http.MethodGet, "/v1/status", nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, "Outbox:", OutboxDepth(), "queued")
+		return 1
+	}
+
+	var s AgentStatus
+	if err := json.Unmarshal(b, &s); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid status response:", err)
+		return 1
+	}
+
+	if jsonOut {
+		b, _ := json.MarshalIndent(s, "", "  ")
+		fmt.Println(string(b))
+	} else {
+		PrintStatus(s)
+	}
+	return 0
+}
+
+const localUsage = `usage:
+  -m local identity                                    print the agent id, pk and hostname as json
+  -m local customfield <name> <value> [<name> <value>]  set custom field values on this agent
+  -m local alert <info|warning|error> <message>        raise an alert for this agent
+  -m local note <text>                                 add a note to this agent
+  -m local runchecks                                   run every check now`
+
+// LocalCLI is a thin wrapper around the local api for shell scripts, it returns the exit code
+func LocalCLI(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, localUsage)
+		return 2
+	}
+
+	var (
+		method = http.MethodPost
+		path   string
+		body   interface{}
+	)
+	switch args[0] {
+	case "identity":
+		method, path = http.MethodGet, "/v1/identity"
+	case "customfield":
+		if len(args) < 3 || len(args)%2 != 1 {
+			fmt.Fprintln(os.Stderr, localUsage)
+			return 2
+		}
+		fields := make(map[string]string)
+		for i := 1; i < len(args); i += 2 {
+			fields[args[i]] = args[i+1]
+		}
+		path, body = "/v1/customfields", localCustomFields{Fields: fields}
+	case "alert":
+		if len(args) < 3 {
+			fmt.Fprintln(os.Stderr, localUsage)
+			return 2
+		}
+		path, body = "/v1/alerts", localAlert{Severity: args[1], Message: strings.Join(args[2:], " ")}
+	case "note":
+		if len(args) < 2 {
+			fmt.Fprintln(os.Stderr, localUsage)
+			return 2
+		}
+		path, body = "/v1/notes", localNote{Note: strings.Join(args[1:], " ")}
+	case "runchecks":
+		path = "/v1/checks/run"
+	default:
+		fmt.Fprintln(os.Stderr, localUsage)
+		return 2
+	}
+
+	b, err := localRequest(method, path, body)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Print(string(b))
+	return 0
+}
@@ -0,0 +1,253 @@
+/*
+Copyright 2023 AmidaWare Inc.
+
+Licensed under the Tactical RMM License Version 1.0 (the “License”).
+You may only use the Licensed Software in accordance with the License.
+A copy of the License is available at:
+
+https://license.tacticalrmm.com
+
+*/
+
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// The outbox is a directory of json files, one per api request that could not be delivered.
+// A directory is used instead of a database since on windows checks run in a separate
+// process that has to be able to queue results while the service is draining.
+
+const (
+	checkResultTTL   = 24 * time.Hour
+	historyResultTTL = 72 * time.Hour
+	outboxMaxEntries = 5000
+	outboxMinBackoff = 15 * time.Second
+	outboxMaxBackoff = 30 * time.Minute
+	outboxDrainEvery = 15 * time.Second
+
+	outboxCollectedAtField = "collected_at"
+)
+
+var (
+	outboxMu      sync.Mutex
+	outboxCounter uint64
+)
+
+type outboxEntry struct {
+	Method      string          `json:"method"`
+	URL         string          `json:"url"`
+	Body        json.RawMessage `json:"body"`
+	Created     time.Time       `json:"created"`
+	Expires     time.Time       `json:"expires"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	LastError   string          `json:"last_error"`
+}
+
+func outboxDir() string {
+	return filepath.Join(agentStateDir(), "outbox")
+}
+
+// outboxFiles returns the queued entries oldest first, the file names sort in creation order
+func outboxFiles() []string {
+	files, err := filepath.Glob(filepath.Join(outboxDir(), "*.json"))
+	if err != nil {
+		return []string{}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// OutboxDepth returns the number of api requests waiting to be delivered
+func OutboxDepth() int {
+	return len(outboxFiles())
+}
+
+func writeOutboxEntry(path string, e outboxEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (a *Agent) enqueueOutbox(e outboxEntry) error {
+	dir := outboxDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	// drop the oldest entries instead of filling the disk during a long outage
+	if files := outboxFiles(); len(files) >= outboxMaxEntries {
+		for _, f := range files[:len(files)-outboxMaxEntries+1] {
+			a.Logger.Debugln("outbox full, dropping", f)
+			os.Remove(f)
+		}
+	}
+
+	name := fmt.Sprintf("%020d-%d-%d.json", time.Now().UnixNano(), os.Getpid(), atomic.AddUint64(&outboxCounter, 1))
+	return writeOutboxEntry(filepath.Join(dir, name), e)
+}
+
+// outboxRetryable reports whether a failed request should be retried later,
+// other client errors will fail the same way every time
+func outboxRetryable(r *resty.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch code := r.StatusCode(); {
+	case code >= 500, code == http.StatusRequestTimeout, code == http.StatusTooManyRequests:
+		return true
+	}
+	return false
+}
+
+func sendOutboxRequest(r *resty.Client, method, url string, body []byte) (*resty.Response, error) {
+	return r.R().
+		SetHeader("Content-Type", "application/json").
+		SetBody(body).
+		Execute(method, url)
+}
+
+// withCollectedAt adds the time a result was queued to a json object body when it is replayed,
+// so results sent after an outage keep their original time. Live sends go out unchanged.
+// Other bodies and objects that already have the field are returned as is.
+func withCollectedAt(body []byte, created time.Time) []byte {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(body, &m); err != nil || m == nil {
+		return body
+	}
+	if _, ok := m[outboxCollectedAtField]; ok {
+		return body
+	}
+	m[outboxCollectedAtField], _ = json.Marshal(created.UTC().Format(time.RFC3339))
+	b, err := json.Marshal(m)
+	if err != nil {
+		return body
+	}
+	return b
+}
+
+// SendResult delivers body to the api, if that fails it is queued in the outbox and
+// retried until it is delivered or ttl expires. Requests queued earlier are always sent first.
+func (a *Agent) SendResult(r *resty.Client, method, url string, body interface{}, ttl time.Duration) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		a.Logger.Errorln("SendResult():", err)
+		return
+	}
+
+	now := time.Now()
+	e := outboxEntry{
+		Method:  method,
+		URL:     url,
+		Body:    b,
+		Created: now,
+		Expires: now.Add(ttl),
+	}
+
+	if OutboxDepth() == 0 && !isAPIUnreachable() {
+		resp, err := sendOutboxRequest(r, method, url, e.Body)
+		if err == nil && !resp.IsError() {
+			return
+		}
+		if !outboxRetryable(resp, err) {
+			a.Logger.Debugln("SendResult()", method, url, resp.StatusCode(), resp.String())
+			return
+		}
+		if err != nil {
+			e.LastError = err.Error()
+		} else {
+			e.LastError = resp.Status()
+		}
+		e.Attempts = 1
+		e.NextAttempt = time.Now().Add(outboxMinBackoff)
+	}
+
+	if err := a.enqueueOutbox(e); err != nil {
+		a.Logger.Errorln("SendResult() enqueue:", err)
+	}
+}
+
+// DrainOutbox sends the queued requests in order and stops at the first one that still fails
+func (a *Agent) DrainOutbox() {
+	outboxMu.Lock()
+	defer outboxMu.Unlock()
+
+	for _, f := range outboxFiles() {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		var e outboxEntry
+		if err := json.Unmarshal(b, &e); err != nil {
+			a.Logger.Debugln("DrainOutbox() removing corrupt entry", f, err)
+			os.Remove(f)
+			continue
+		}
+
+		if time.Now().After(e.Expires) {
+			a.Logger.Debugln("DrainOutbox() expired", e.Method, e.URL, "queued at", e.Created)
+			os.Remove(f)
+			continue
+		}
+		if time.Now().Before(e.NextAttempt) {
+			return
+		}
+
+		resp, err := sendOutboxRequest(a.restClient(), e.Method, e.URL, withCollectedAt(e.Body, e.Created))
+		if err == nil && !resp.IsError() {
+			setAPIUnreachable(false)
+			os.Remove(f)
+			continue
+		}
+		if !outboxRetryable(resp, err) {
+			a.Logger.Debugln("DrainOutbox() dropping", e.Method, e.URL, resp.StatusCode(), resp.String())
+			os.Remove(f)
+			continue
+		}
+
+		// exponential backoff on the head of the queue, everything behind it waits
+		e.Attempts++
+		backoff := outboxMinBackoff << (e.Attempts - 1)
+		if backoff > outboxMaxBackoff || backoff <= 0 {
+			backoff = outboxMaxBackoff
+		}
+		e.NextAttempt = time.Now().Add(backoff)
+		if err != nil {
+			e.LastError = err.Error()
+		} else {
+			e.LastError = resp.Status()
+		}
+		a.Logger.Debugln("DrainOutbox()", e.Method, e.URL, "failed:", strings.TrimSpace(e.LastError), "retrying in", backoff)
+		if err := writeOutboxEntry(f, e); err != nil {
+			a.Logger.Errorln("DrainOutbox()", err)
+		}
+		return
+	}
+}
+
+func (a *Agent) OutboxDrainer() {
+	ticker := time.NewTicker(outboxDrainEvery)
+	defer ticker.Stop()
+	for range ticker.C {
+		a.DrainOutbox()
+	}
+}
@@ -0,0 +1,478 @@
+/*
+Copyright 2023 AmidaWare Inc.
+
+Licensed under the Tactical RMM License Version 1.0 (the “License”).
+You may only use the Licensed Software in accordance with the License.
+A copy of the License is available at:
+
+https://license.tacticalrmm.com
+
+*/
+
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	rmm "github.com/amidaware/rmmagent/shared"
+	trmm "github.com/wh1te909/trmm-shared"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+)
+
+const (
+	pkgMgrRefreshTimeout = 600
+	pkgMgrInstallTimeout = 1800
+
+	// written when patch management is enabled so unattended-upgrades leaves patching to the rmm
+	aptNoAutoUpgradeConf = "/etc/apt/apt.conf.d/99tacticalrmm-patchmgmt"
+	aptNoAutoUpgrade     = "APT::Periodic::Unattended-Upgrade \"0\";\n"
+)
+
+// timers disabled by PatchMgmnt are recorded so they can be re-enabled when patch management is turned off
+var autoUpdateUnits = []string{"dnf-automatic.timer", "dnf-automatic-install.timer", "yum-cron.service"}
+var autoUpdateUnitsState = filepath.Join(nixAgentEtcDir, "patchmgmt_disabled_units")
+
+// Inst libssl3 [3.0.2-0ubuntu1.10] (3.0.2-0ubuntu1.12 Ubuntu:22.04/jammy-updates, Ubuntu:22.04/jammy-security [amd64])
+var aptInstRegex = regexp.MustCompile(`^Inst (\S+) (?:\[(\S+)\] )?\((\S+) (.*)\)`)
+
+var pkgMgrEnv = []string{"LANG=C", "LC_ALL=C", "DEBIAN_FRONTEND=noninteractive"}
+var aptOpts = []string{"-o", "DPkg::Lock::Timeout=300", "-o", "Dpkg::Options::=--force-confdef", "-o", "Dpkg::Options::=--force-confold"}
+
+// detectPkgMgr returns the package manager used for patching on this host
+func detectPkgMgr() string {
+	for _, mgr := range []string{"apt-get", "dnf", "yum", "zypper"} {
+		if _, err := exec.LookPath(mgr); err == nil {
+			return mgr
+		}
+	}
+	return ""
+}
+
+func (a *Agent) runPkgMgr(timeout int, bin string, args ...string) CmdStatus {
+	opts := a.NewCMDOpts()
+	opts.IsScript = true
+	opts.Shell = bin
+	opts.Args = args
+	opts.Timeout = time.Duration(timeout)
+	opts.EnvVars = pkgMgrEnv
+	return a.CmdV2(opts)
+}
+
+func newLinuxUpdate(name, current, available string, security bool) rmm.WUAPackage {
+	category := "Updates"
+	severity := ""
+	if security {
+		category = "Security Updates"
+		severity = "Important"
+	}
+	desc := fmt.Sprintf("Upgrade %s to %s", name, available)
+	if current != "" {
+		desc = fmt.Sprintf("Upgrade %s from %s to %s", name, current, available)
+	}
+	return rmm.WUAPackage{
+		Title:        fmt.Sprintf("%s %s", name, available),
+		Description:  desc,
+		Categories:   []string{category},
+		CategoryIDs:  []string{},
+		KBArticleIDs: []string{},
+		MoreInfoURLs: []string{},
+		UpdateID:     name,
+		Severity:     severity,
+		Installed:    false,
+		Downloaded:   false,
+	}
+}
+
+// refreshPkgMgr syncs the repository metadata so pending updates are current
+func (a *Agent) refreshPkgMgr(mgr string) {
+	var out CmdStatus
+	switch mgr {
+	case "apt-get":
+		out = a.runPkgMgr(pkgMgrRefreshTimeout, mgr, append([]string{"update", "-q"}, aptOpts...)...)
+	case "dnf", "yum":
+		out = a.runPkgMgr(pkgMgrRefreshTimeout, mgr, "-q", "makecache")
+	case "zypper":
+		out = a.runPkgMgr(pkgMgrRefreshTimeout, mgr, "-n", "-q", "refresh")
+	default:
+		return
+	}
+	if out.Status.Error != nil || out.Status.Exit != 0 {
+		a.Logger.Debugln("refreshPkgMgr():", mgr, out.Status.Exit, out.Status.Error, out.Stderr)
+	}
+}
+
+// pendingUpdates lists the packages that can be upgraded, keyed by the id used to install them
+func (a *Agent) pendingUpdates(mgr string) ([]rmm.WUAPackage, error) {
+	switch mgr {
+	case "apt-get":
+		return a.aptPendingUpdates()
+	case "dnf", "yum":
+		return a.dnfPendingUpdates(mgr)
+	case "zypper":
+		return a.zypperPendingUpdates()
+	}
+	return nil, errors.New("no supported package manager found")
+}
+
+func (a *Agent) aptPendingUpdates() ([]rmm.WUAPackage, error) {
+	ret := make([]rmm.WUAPackage, 0)
+	args := append([]string{"-s", "-q", "dist-upgrade"}, aptOpts...)
+	out := a.runPkgMgr(pkgMgrRefreshTimeout, "apt-get", args...)
+	if out.Status.Error != nil {
+		return ret, out.Status.Error
+	}
+	if out.Status.Exit != 0 {
+		return ret, fmt.Errorf("apt-get exited with code %d: %s", out.Status.Exit, out.Stderr)
+	}
+
+	for _, line := range strings.Split(out.Stdout, "\n") {
+		m := aptInstRegex.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		security := strings.Contains(strings.ToLower(m[4]), "-security")
+		ret = append(ret, newLinuxUpdate(m[1], m[2], m[3], security))
+	}
+	return ret, nil
+}
+
+// nevraToNameArch turns openssl-1:3.0.7-6.el9_2.x86_64 into openssl.x86_64
+func nevraToNameArch(nevra string) string {
+	dot := strings.LastIndex(nevra, ".")
+	if dot == -1 {
+		return nevra
+	}
+	nevr, arch := nevra[:dot], nevra[dot+1:]
+	for i := 0; i < 2; i++ {
+		dash := strings.LastIndex(nevr, "-")
+		if dash == -1 {
+			return nevra
+		}
+		nevr = nevr[:dash]
+	}
+	return nevr + "." + arch
+}
+
+func (a *Agent) dnfPendingUpdates(mgr string) ([]rmm.WUAPackage, error) {
+	ret := make([]rmm.WUAPackage, 0)
+
+	// advisory id and severity per name.arch
+	type advisory struct {
+		ids      []string
+		severity string
+	}
+	security := make(map[string]*advisory)
+	sec := a.runPkgMgr(pkgMgrRefreshTimeout, mgr, "-q", "-C", "updateinfo", "list", "security")
+	if sec.Status.Error == nil && sec.Status.Exit == 0 {
+		// RHSA-2023:3722 Important/Sec. openssl-1:3.0.7-6.el9_2.x86_64
+		for _, line := range strings.Split(sec.Stdout, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) != 3 {
+				continue
+			}
+			key := nevraToNameArch(fields[2])
+			adv, ok := security[key]
+			if !ok {
+				adv = &advisory{}
+				security[key] = adv
+			}
+			adv.ids = append(adv.ids, fields[0])
+			if sev, _, found := strings.Cut(fields[1], "/"); found && adv.severity == "" {
+				adv.severity = sev
+			}
+		}
+	} else {
+		a.Logger.Debugln("dnfPendingUpdates() updateinfo:", sec.Status.Exit, sec.Stderr)
+	}
+
+	// check-update exits with 100 when updates are available
+	out := a.runPkgMgr(pkgMgrRefreshTimeout, mgr, "-q", "-C", "check-update")
+	if out.Status.Error != nil {
+		return ret, out.Status.Error
+	}
+	if out.Status.Exit != 0 && out.Status.Exit != 100 {
+		return ret, fmt.Errorf("%s exited with code %d: %s", mgr, out.Status.Exit, out.Stderr)
+	}
+
+	// yum wraps long package names onto their own line
+	var carry string
+	for _, line := range strings.Split(out.Stdout, "\n") {
+		if strings.HasPrefix(line, "Obsoleting Packages") {
+			break
+		}
+		fields := strings.Fields(carry + " " + line)
+		if len(fields) == 1 {
+			carry = fields[0]
+			continue
+		}
+		carry = ""
+		if len(fields) != 3 || !strings.Contains(fields[0], ".") {
+			continue
+		}
+
+		adv, isSecurity := security[fields[0]]
+		u := newLinuxUpdate(fields[0], "", fields[1], isSecurity)
+		if isSecurity {
+			u.KBArticleIDs = adv.ids
+			if adv.severity != "" {
+				u.Severity = adv.severity
+			}
+		}
+		ret = append(ret, u)
+	}
+	return ret, nil
+}
+
+// parseZypperTable parses the | separated tables printed by zypper into header -> value maps
+func parseZypperTable(out string) []map[string]string {
+	ret := make([]map[string]string, 0)
+	var header []string
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.Contains(line, "|") || strings.HasPrefix(line, "--") {
+			continue
+		}
+		cols := strings.Split(line, "|")
+		for i := range cols {
+			cols[i] = strings.TrimSpace(cols[i])
+		}
+		if header == nil {
+			header = cols
+			continue
+		}
+		if len(cols) != len(header) {
+			continue
+		}
+		row := make(map[string]string)
+		for i, h := range header {
+			row[h] = cols[i]
+		}
+		ret = append(ret, row)
+	}
+	return ret
+}
+
+// zypperPendingUpdates returns needed security patches as patch:<name> and regular package updates by name
+func (a *Agent) zypperPendingUpdates() ([]rmm.WUAPackage, error) {
+	ret := make([]rmm.WUAPackage, 0)
+
+	patches := a.runPkgMgr(pkgMgrRefreshTimeout, "zypper", "-n", "--no-refresh", "list-patches", "--category", "security")
+	if patches.Status.Error == nil && patches.Status.Exit == 0 {
+		for _, row := range parseZypperTable(patches.Stdout) {
+			if row["Name"] == "" || (row["Status"] != "" && row["Status"] != "needed") {
+				continue
+			}
+			u := newLinuxUpdate("patch:"+row["Name"], "", row["Name"], true)
+			u.Title = row["Name"]
+			u.Description = row["Summary"]
+			u.KBArticleIDs = []string{row["Name"]}
+			if row["Severity"] != "" {
+				u.Severity = cases.Title(language.AmericanEnglish).String(row["Severity"])
+			}
+			ret = append(ret, u)
+		}
+	} else {
+		a.Logger.Debugln("zypperPendingUpdates() list-patches:", patches.Status.Exit, patches.Stderr)
+	}
+
+	out := a.runPkgMgr(pkgMgrRefreshTimeout, "zypper", "-n", "--no-refresh", "list-updates")
+	if out.Status.Error != nil {
+		return ret, out.Status.Error
+	}
+	if out.Status.Exit != 0 {
+		return ret, fmt.Errorf("zypper exited with code %d: %s", out.Status.Exit, out.Stderr)
+	}
+	for _, row := range parseZypperTable(out.Stdout) {
+		if row["Name"] == "" {
+			continue
+		}
+		ret = append(ret, newLinuxUpdate(row["Name"], row["Current Version"], row["Available Version"], false))
+	}
+	return ret, nil
+}
+
+func (a *Agent) installPkgUpdate(mgr, id string) error {
+	var out CmdStatus
+	switch mgr {
+	case "apt-get":
+		args := append([]string{"install", "-y", "-q", "--only-upgrade"}, aptOpts...)
+		out = a.runPkgMgr(pkgMgrInstallTimeout, mgr, append(args, id)...)
+	case "dnf":
+		out = a.runPkgMgr(pkgMgrInstallTimeout, mgr, "-y", "upgrade", id)
+	case "yum":
+		out = a.runPkgMgr(pkgMgrInstallTimeout, mgr, "-y", "update", id)
+	case "zypper":
+		if patch, ok := strings.CutPrefix(id, "patch:"); ok {
+			out = a.runPkgMgr(pkgMgrInstallTimeout, mgr, "-n", "--no-refresh", "install", "-t", "patch", patch)
+		} else {
+			out = a.runPkgMgr(pkgMgrInstallTimeout, mgr, "-n", "--no-refresh", "update", id)
+		}
+		// 100-103 are informational, 102 and 103 mean a reboot or zypper restart is needed.
+		// 104 and up are failures like 105 interrupted, 106 repositories skipped and 107 rpm scriptlets failed
+		// https://en.opensuse.org/SDB:Zypper_manual#EXIT_CODES
+		if out.Status.Error == nil && out.Status.Exit >= 100 && out.Status.Exit <= 103 {
+			return nil
+		}
+	default:
+		return errors.New("no supported package manager found")
+	}
+
+	if out.Status.Error != nil {
+		return out.Status.Error
+	}
+	if out.Status.Exit != 0 {
+		return fmt.Errorf("%s exited with code %d: %s", mgr, out.Status.Exit, out.Stderr)
+	}
+	return nil
+}
+
+func (a *Agent) GetWinUpdates() {
+	mgr := detectPkgMgr()
+	if mgr == "" {
+		a.Logger.Debugln("GetWinUpdates(): no supported package manager found")
+		return
+	}
+
+	a.refreshPkgMgr(mgr)
+	updates, err := a.pendingUpdates(mgr)
+	if err != nil {
+		a.Logger.Errorln("GetWinUpdates():", err)
+		return
+	}
+
+	for _, update := range updates {
+		a.Logger.Debugln("ID:", update.UpdateID)
+		a.Logger.Debugln("Title:", update.Title)
+		a.Logger.Debugln("Categories:", update.Categories)
+		a.Logger.Debugln("--------------------------------")
+	}
+
+	payload := rmm.WinUpdateResult{AgentID: a.AgentID, Updates: updates}
+	_, err = a.restClient().R().SetBody(payload).Post("/api/v3/winupdates/")
+	if err != nil {
+		a.Logger.Debugln(err)
+	}
+}
+
+func (a *Agent) InstallUpdates(guids []string) {
+	mgr := detectPkgMgr()
+	if mgr == "" {
+		a.Logger.Errorln("InstallUpdates(): no supported package manager found")
+		return
+	}
+
+	// without the pending list an update that is no longer needed would be reported as failed
+	updates, err := a.pendingUpdates(mgr)
+	if err != nil {
+		a.Logger.Errorln("InstallUpdates():", err)
+		return
+	}
+	pending := make(map[string]struct{})
+	for _, u := range updates {
+		pending[u.UpdateID] = struct{}{}
+	}
+
+	for _, id := range guids {
+		var result rmm.WinUpdateInstallResult
+		result.AgentID = a.AgentID
+		result.UpdateID = id
+
+		// already upgraded as a dependency of another package or replaced by a newer version
+		if _, ok := pending[id]; !ok {
+			superseded := rmm.SupersededUpdate{AgentID: a.AgentID, UpdateID: id}
+			a.restClient().R().SetBody(superseded).Post("/api/v3/superseded/")
+			continue
+		}
+
+		if ierr := a.installPkgUpdate(mgr, id); ierr != nil {
+			a.Logger.Errorln("InstallUpdates():", id, ierr)
+			result.Success = false
+			a.restClient().R().SetBody(result).Patch("/api/v3/winupdates/")
+			continue
+		}
+		result.Success = true
+		a.restClient().R().SetBody(result).Patch("/api/v3/winupdates/")
+		a.Logger.Debugln("Installed update", id)
+	}
+
+	time.Sleep(5 * time.Second)
+	needsReboot, err := a.SystemRebootRequired()
+	if err != nil {
+		a.Logger.Errorln(err)
+	}
+	rebootPayload := rmm.AgentNeedsReboot{AgentID: a.AgentID, NeedsReboot: needsReboot}
+	_, err = a.restClient().R().SetBody(rebootPayload).Put("/api/v3/winupdates/")
+	if err != nil {
+		a.Logger.Debugln("NeedsReboot:", err)
+	}
+}
+
+// PatchMgmnt enables/disables the distro's automatic updates
+// enable - the rmm manages patching, unattended-upgrades and dnf-automatic/yum-cron are turned off
+// disable - restore the automatic updates the agent turned off
+func (a *Agent) PatchMgmnt(enable bool) error {
+	if enable {
+		if trmm.FileExists("/etc/apt/apt.conf.d") {
+			if err := os.WriteFile(aptNoAutoUpgradeConf, []byte(aptNoAutoUpgrade), 0644); err != nil {
+				return err
+			}
+		}
+
+		if !systemdBooted() {
+			return nil
+		}
+		disabled := make([]string, 0)
+		for _, unit := range autoUpdateUnits {
+			out := a.systemctl("is-enabled", unit)
+			if strings.TrimSpace(out.Stdout) != "enabled" {
+				continue
+			}
+			if out := a.systemctl("disable", "--now", unit); out.Status.Exit != 0 {
+				return fmt.Errorf("failed to disable %s: %s", unit, strings.TrimSpace(out.Stderr))
+			}
+			disabled = append(disabled, unit)
+		}
+		if len(disabled) == 0 {
+			return nil
+		}
+		// enabling again must not lose the units recorded the first time, they are disabled now
+		if content, err := os.ReadFile(autoUpdateUnitsState); err == nil {
+			for _, unit := range strings.Fields(string(content)) {
+				if !stringInSlice(unit, disabled) {
+					disabled = append(disabled, unit)
+				}
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(autoUpdateUnitsState), 0755); err != nil {
+			return err
+		}
+		return os.WriteFile(autoUpdateUnitsState, []byte(strings.Join(disabled, "\n")), 0644)
+	}
+
+	if err := os.Remove(aptNoAutoUpgradeConf); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	content, err := os.ReadFile(autoUpdateUnitsState)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if systemdBooted() {
+		for _, unit := range strings.Fields(string(content)) {
+			if out := a.systemctl("enable", "--now", unit); out.Status.Exit != 0 {
+				return fmt.Errorf("failed to enable %s: %s", unit, strings.TrimSpace(out.Stderr))
+			}
+		}
+	}
+	return os.Remove(autoUpdateUnitsState)
+}
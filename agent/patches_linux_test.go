@@ -0,0 +1,120 @@
+/*
+Copyright 2023 AmidaWare Inc.
+
+Licensed under the Tactical RMM License Version 1.0 (the “License”).
+You may only use the Licensed Software in accordance with the License.
+A copy of the License is available at:
+
+https://license.tacticalrmm.com
+
+*/
+
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// useFakePkgMgrs puts the fake package managers in testdata/pkgmgr first on the PATH
+func useFakePkgMgrs(t *testing.T) {
+	t.Helper()
+	dir, err := filepath.Abs(filepath.Join("testdata", "pkgmgr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestPendingUpdates(t *testing.T) {
+	useFakePkgMgrs(t)
+	a := testAgent()
+
+	type want struct {
+		id       string
+		security bool
+		severity string
+		kbs      []string
+	}
+	tests := []struct {
+		mgr  string
+		want []want
+	}{
+		{"apt-get", []want{
+			{"libssl3", true, "Important", []string{}},
+			{"curl", false, "", []string{}},
+			{"newpkg", false, "", []string{}},
+		}},
+		{"dnf", []want{
+			{"openssl.x86_64", true, "Important", []string{"RHSA-2023:3722", "RHSA-2023:3723"}},
+			{"a-very-long-package-name-that-wraps.noarch", false, "", []string{}},
+		}},
+		{"zypper", []want{
+			{"patch:openSUSE-SLE-15.5-123", true, "Important", []string{"openSUSE-SLE-15.5-123"}},
+			{"vim", false, "", []string{}},
+		}},
+	}
+
+	for _, tt := range tests {
+		updates, err := a.pendingUpdates(tt.mgr)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.mgr, err)
+		}
+		if len(updates) != len(tt.want) {
+			t.Fatalf("%s: got %d updates, want %d: %+v", tt.mgr, len(updates), len(tt.want), updates)
+		}
+		for i, w := range tt.want {
+			u := updates[i]
+			security := len(u.Categories) == 1 && u.Categories[0] == "Security Updates"
+			if u.UpdateID != w.id || security != w.security || u.Severity != w.severity || !reflect.DeepEqual(u.KBArticleIDs, w.kbs) {
+				t.Errorf("%s: got %s security %v severity %q kbs %v, want %+v", tt.mgr, u.UpdateID, security, u.Severity, u.KBArticleIDs, w)
+			}
+		}
+	}
+}
+
+func TestPendingUpdatesFail(t *testing.T) {
+	useFakePkgMgrs(t)
+	t.Setenv("FAKE_PKGMGR_FAIL", "1")
+	a := testAgent()
+
+	for _, mgr := range []string{"apt-get", "dnf", "zypper"} {
+		if updates, err := a.pendingUpdates(mgr); err == nil {
+			t.Errorf("%s: no error when listing failed, got %+v", mgr, updates)
+		}
+	}
+}
+
+func TestInstallPkgUpdate(t *testing.T) {
+	useFakePkgMgrs(t)
+	a := testAgent()
+
+	tests := []struct {
+		mgr, id string
+		fail    bool
+	}{
+		{"apt-get", "libssl3", false},
+		{"apt-get", "broken", true},
+		{"dnf", "openssl.x86_64", false},
+		{"dnf", "broken", true},
+		// zypper exits with 102 when the patch needs a reboot
+		{"zypper", "patch:openSUSE-SLE-15.5-123", false},
+		{"zypper", "vim", false},
+		{"zypper", "broken", true},
+		{"zypper", "interrupted", true},
+		{"zypper", "scriptlet", true},
+	}
+	for _, tt := range tests {
+		err := a.installPkgUpdate(tt.mgr, tt.id)
+		if (err != nil) != tt.fail {
+			t.Errorf("%s %s: got %v, want failure %v", tt.mgr, tt.id, err, tt.fail)
+		}
+		// the package manager's own message is what the rmm shows for a failed update
+		if err != nil && !strings.Contains(err.Error(), "exited with code") {
+			t.Errorf("%s %s: error %q does not include the exit code and stderr", tt.mgr, tt.id, err)
+		}
+	}
+}
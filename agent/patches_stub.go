@@ -0,0 +1,21 @@
+//go:build !windows && !linux
+// +build !windows,!linux
+
+/*
+Copyright 2023 AmidaWare Inc.
+
+Licensed under the Tactical RMM License Version 1.0 (the “License”).
+You may only use the Licensed Software in accordance with the License.
+A copy of the License is available at:
+
+https://license.tacticalrmm.com
+
+*/
+
+package agent
+
+func (a *Agent) PatchMgmnt(enable bool) error { return nil }
+
+func (a *Agent) GetWinUpdates() {}
+
+func (a *Agent) InstallUpdates(guids []string) {}
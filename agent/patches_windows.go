@@ -34,7 +34,7 @@ func (a *Agent) GetWinUpdates() {
 	}
 
 	payload := rmm.WinUpdateResult{AgentID: a.AgentID, Updates: updates}
-	_, err = a.rClient.R().SetBody(payload).Post("/api/v3/winupdates/")
+	_, err = a.restClient().R().SetBody(payload).Post("/api/v3/winupdates/")
 	if err != nil {
 		a.Logger.Debugln(err)
 	}
@@ -59,7 +59,7 @@ func (a *Agent) InstallUpdates(guids []string) {
 		if err != nil {
 			a.Logger.Errorln(err)
 			result.Success = false
-			a.rClient.R().SetBody(result).Patch("/api/v3/winupdates/")
+			a.restClient().R().SetBody(result).Patch("/api/v3/winupdates/")
 			continue
 		}
 		defer updts.Release()
@@ -68,14 +68,14 @@ func (a *Agent) InstallUpdates(guids []string) {
 		if err != nil {
 			a.Logger.Errorln(err)
 			result.Success = false
-			a.rClient.R().SetBody(result).Patch("/api/v3/winupdates/")
+			a.restClient().R().SetBody(result).Patch("/api/v3/winupdates/")
 			continue
 		}
 		a.Logger.Debugln("updtCnt:", updtCnt)
 
 		if updtCnt == 0 {
 			superseded := rmm.SupersededUpdate{AgentID: a.AgentID, UpdateID: id}
-			a.rClient.R().SetBody(superseded).Post("/api/v3/superseded/")
+			a.restClient().R().SetBody(superseded).Post("/api/v3/superseded/")
 			continue
 		}
 
@@ -84,7 +84,7 @@ func (a *Agent) InstallUpdates(guids []string) {
 			if err != nil {
 				a.Logger.Errorln(err)
 				result.Success = false
-				a.rClient.R().SetBody(result).Patch("/api/v3/winupdates/")
+				a.restClient().R().SetBody(result).Patch("/api/v3/winupdates/")
 				continue
 			}
 			a.Logger.Debugln("u:", u)
@@ -92,11 +92,11 @@ func (a *Agent) InstallUpdates(guids []string) {
 			if err != nil {
 				a.Logger.Errorln(err)
 				result.Success = false
-				a.rClient.R().SetBody(result).Patch("/api/v3/winupdates/")
+				a.restClient().R().SetBody(result).Patch("/api/v3/winupdates/")
 				continue
 			}
 			result.Success = true
-			a.rClient.R().SetBody(result).Patch("/api/v3/winupdates/")
+			a.restClient().R().SetBody(result).Patch("/api/v3/winupdates/")
 			a.Logger.Debugln("Installed windows update with guid", id)
 		}
 	}
@@ -107,7 +107,7 @@ func (a *Agent) InstallUpdates(guids []string) {
 		a.Logger.Errorln(err)
 	}
 	rebootPayload := rmm.AgentNeedsReboot{AgentID: a.AgentID, NeedsReboot: needsReboot}
-	_, err = a.rClient.R().SetBody(rebootPayload).Put("/api/v3/winupdates/")
+	_, err = a.restClient().R().SetBody(rebootPayload).Put("/api/v3/winupdates/")
 	if err != nil {
 		a.Logger.Debugln("NeedsReboot:", err)
 	}
@@ -0,0 +1,171 @@
+/*
+Copyright 2023 AmidaWare Inc.
+
+Licensed under the Tactical RMM License Version 1.0 (the “License”).
+You may only use the Licensed Software in accordance with the License.
+A copy of the License is available at:
+
+https://license.tacticalrmm.com
+
+*/
+
+package agent
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	rmm "github.com/amidaware/rmmagent/shared"
+	"github.com/go-resty/resty/v2"
+	gops "github.com/shirou/gopsutil/v3/process"
+)
+
+// cpu usage is measured over this long instead of since the process started
+const procCheckCPUInterval = 2 * time.Second
+
+func (a *Agent) SendProcessCheckResult(payload rmm.ProcessCheckResponse, r *resty.Client) {
+	a.SendResult(r, http.MethodPatch, "/api/v3/checkrunner/", payload, checkResultTTL)
+}
+
+// ProcessCheck finds the processes matching every one of data.ProcessName, data.ProcessExe and data.CmdlineRegex that is set.
+// It fails if there are fewer than data.MinInstances, default 1, or more than data.MaxInstances,
+// or if a matching process is over the cpu, rss or open files threshold.
+// The cpu percentage is per core like top, so a process using two cores is at 200.
+func (a *Agent) ProcessCheck(data rmm.Check) (payload rmm.ProcessCheckResponse) {
+	payload.ID = data.CheckPK
+	payload.AgentID = a.AgentID
+	payload.Status = "failing"
+	payload.PIDs = []int32{}
+
+	if data.ProcessName == "" && data.ProcessExe == "" && data.CmdlineRegex == "" {
+		payload.MoreInfo = "No process name, exe or cmdline regex to match"
+		return
+	}
+	var cmdRe *regexp.Regexp
+	if data.CmdlineRegex != "" {
+		var err error
+		cmdRe, err = regexp.Compile(data.CmdlineRegex)
+		if err != nil {
+			payload.MoreInfo = fmt.Sprintf("Invalid cmdline regex: %v", err)
+			return
+		}
+	}
+
+	procs, err := gops.Processes()
+	if err != nil {
+		a.Logger.Debugln("ProcessCheck:", err)
+		payload.MoreInfo = err.Error()
+		return
+	}
+
+	matched := make([]*gops.Process, 0)
+	names := make(map[int32]string)
+	for _, p := range procs {
+		if p.Pid == 0 {
+			continue
+		}
+		name, err := p.Name()
+		if err != nil {
+			continue
+		}
+		if data.ProcessName != "" && !samePath(name, data.ProcessName) {
+			continue
+		}
+		if data.ProcessExe != "" {
+			exe, err := p.Exe()
+			if err != nil || !samePath(filepath.Clean(exe), filepath.Clean(data.ProcessExe)) {
+				continue
+			}
+		}
+		if cmdRe != nil {
+			cmdline, err := p.Cmdline()
+			if err != nil || !cmdRe.MatchString(cmdline) {
+				continue
+			}
+		}
+		matched = append(matched, p)
+		names[p.Pid] = name
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].Pid < matched[j].Pid })
+
+	problems := make([]string, 0)
+	minInstances := 1
+	if data.MinInstances != nil {
+		minInstances = *data.MinInstances
+	}
+	if len(matched) < minInstances {
+		problems = append(problems, fmt.Sprintf("%d running, expected at least %d", len(matched), minInstances))
+	}
+	if data.MaxInstances != nil && len(matched) > *data.MaxInstances {
+		problems = append(problems, fmt.Sprintf("%d running, expected at most %d", len(matched), *data.MaxInstances))
+	}
+
+	cpu := make(map[int32]float64)
+	if data.MaxCPUPercent > 0 && len(matched) > 0 {
+		// the first call only records the cpu times
+		for _, p := range matched {
+			p.Percent(0)
+		}
+		time.Sleep(procCheckCPUInterval)
+		for _, p := range matched {
+			if pct, err := p.Percent(0); err == nil {
+				cpu[p.Pid] = pct
+			}
+		}
+	}
+
+	lines := make([]string, 0, len(matched))
+	for _, p := range matched {
+		payload.PIDs = append(payload.PIDs, p.Pid)
+		line := fmt.Sprintf("pid %d %s", p.Pid, names[p.Pid])
+
+		if pct, ok := cpu[p.Pid]; ok {
+			line += fmt.Sprintf(", cpu %.1f%%", pct)
+			if pct > data.MaxCPUPercent {
+				problems = append(problems, fmt.Sprintf("pid %d cpu %.1f%% is over %.1f%%", p.Pid, pct, data.MaxCPUPercent))
+			}
+		}
+		if mem, err := p.MemoryInfo(); err == nil {
+			line += ", rss " + ByteCountSI(mem.RSS)
+			if data.MaxRSSMB > 0 && mem.RSS > uint64(data.MaxRSSMB)*1024*1024 {
+				problems = append(problems, fmt.Sprintf("pid %d rss %s is over %d MB", p.Pid, ByteCountSI(mem.RSS), data.MaxRSSMB))
+			}
+		}
+		if data.MaxOpenFiles > 0 {
+			if fds, err := p.NumFDs(); err != nil {
+				line += ", open files unknown: " + err.Error()
+			} else {
+				line += fmt.Sprintf(", %d open files", fds)
+				if int(fds) > data.MaxOpenFiles {
+					problems = append(problems, fmt.Sprintf("pid %d has %d open files, over %d", p.Pid, fds, data.MaxOpenFiles))
+				}
+			}
+		}
+		lines = append(lines, line)
+	}
+
+	payload.MoreInfo = fmt.Sprintf("%d matching processes", len(matched))
+	if len(lines) > 0 {
+		payload.MoreInfo += "\n" + strings.Join(lines, "\n")
+	}
+	if len(problems) > 0 {
+		payload.MoreInfo = strings.Join(problems, "\n") + "\n" + payload.MoreInfo
+		return
+	}
+	payload.Status = "passing"
+	return
+}
+
+// samePath compares process names and paths, windows ignores case
+func samePath(a, b string) bool {
+	if runtime.GOOS == "windows" {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
@@ -0,0 +1,251 @@
+/*
+Copyright 2023 AmidaWare Inc.
+
+Licensed under the Tactical RMM License Version 1.0 (the “License”).
+You may only use the Licensed Software in accordance with the License.
+A copy of the License is available at:
+
+https://license.tacticalrmm.com
+
+*/
+
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	nats "github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// the replaced nats connection stays open until the rpcs it received have replied
+	oldConnPollInterval = 5 * time.Second
+	oldConnMaxWait      = time.Hour
+)
+
+// rpcConn is the nats connection RunRPC serves, ReloadConfig replaces it when the transport settings change
+var rpcConn struct {
+	sync.RWMutex
+	nc     *nats.Conn
+	sub    *nats.Subscription
+	router *rpcRouter
+}
+
+var reloadMu sync.Mutex
+
+// cfgMu guards the Agent fields ReloadConfig replaces, code that can run while
+// the service is up reads them through settings() and restClient()
+var cfgMu sync.RWMutex
+
+// ConfigReloadResult lists the settings a reload changed
+type ConfigReloadResult struct {
+	Changed     []string `json:"changed"`
+	Reconnected bool     `json:"reconnected"`
+}
+
+// liveSettings is a copy of the Agent fields ReloadConfig can replace while the service runs
+type liveSettings struct {
+	BaseURL            string
+	ApiURL             string
+	Token              string
+	Proxy              string
+	Cert               string
+	Insecure           bool
+	NatsServer         string
+	NatsProxyPath      string
+	NatsProxyPort      string
+	NatsPingInterval   int
+	NatsWSCompression  bool
+	WinTmpDir          string
+	WinRunAsUserTmpDir string
+}
+
+func (a *Agent) settings() liveSettings {
+	cfgMu.RLock()
+	defer cfgMu.RUnlock()
+	return liveSettings{
+		BaseURL:            a.BaseURL,
+		ApiURL:             a.ApiURL,
+		Token:              a.Token,
+		Proxy:              a.Proxy,
+		Cert:               a.Cert,
+		Insecure:           a.Insecure,
+		NatsServer:         a.NatsServer,
+		NatsProxyPath:      a.NatsProxyPath,
+		NatsProxyPort:      a.NatsProxyPort,
+		NatsPingInterval:   a.NatsPingInterval,
+		NatsWSCompression:  a.NatsWSCompression,
+		WinTmpDir:          a.WinTmpDir,
+		WinRunAsUserTmpDir: a.WinRunAsUserTmpDir,
+	}
+}
+
+func (a *Agent) restClient() *resty.Client {
+	cfgMu.RLock()
+	defer cfgMu.RUnlock()
+	return a.rClient
+}
+
+func currentNatsConn() *nats.Conn {
+	rpcConn.RLock()
+	defer rpcConn.RUnlock()
+	return rpcConn.nc
+}
+
+func (a *Agent) subscribeRPC(nc *nats.Conn, router *rpcRouter) (*nats.Subscription, error) {
+	return nc.Subscribe(a.AgentID, func(msg *nats.Msg) {
+		router.dispatch(msg.Data, nc, msg.Respond)
+	})
+}
+
+// ReloadConfig re-reads the agent config and applies it without restarting the service.
+// The new config is validated first and the running one is kept if it is invalid.
+// The nats connection is only replaced when a setting it uses changed.
+// The agent id and the rpc worker settings cannot be changed without a restart.
+func (a *Agent) ReloadConfig() (ConfigReloadResult, error) {
+	ret, err := a.reloadConfig()
+	recordReload(err)
+	return ret, err
+}
+
+func (a *Agent) reloadConfig() (ConfigReloadResult, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	ret := ConfigReloadResult{Changed: []string{}}
+
+	ac := NewAgentConfig()
+	if err := ValidateAgentConfig(ac); err != nil {
+		return ret, fmt.Errorf("invalid config, keeping the current one: %w", err)
+	}
+	if ac.AgentID != a.AgentID || ac.PK != a.AgentPK {
+		return ret, errors.New("agentid and agentpk cannot be changed without a restart")
+	}
+
+	ns := newNatsSettings(ac)
+	// an unset ping interval is randomized, keep the current one instead of reconnecting for nothing
+	if ac.NatsPingInterval == 0 {
+		ns.pingInterval = a.NatsPingInterval
+	}
+	insecure := ac.Insecure == "true"
+
+	changed := func(name string, old, cur interface{}) bool {
+		if old == cur {
+			return false
+		}
+		ret.Changed = append(ret.Changed, name)
+		return true
+	}
+
+	restChanged := changed("baseurl", a.BaseURL, ac.BaseURL)
+	restChanged = changed("token", a.Token, ac.Token) || restChanged
+	restChanged = changed("proxy", a.Proxy, ac.Proxy) || restChanged
+	restChanged = changed("cert", a.Cert, ac.Cert) || restChanged
+	restChanged = changed("insecure", strconv.FormatBool(a.Insecure), strconv.FormatBool(insecure)) || restChanged
+
+	natsChanged := changed("apiurl", a.ApiURL, ac.APIURL)
+	natsChanged = changed("natsserver", a.NatsServer, ns.server) || natsChanged
+	natsChanged = changed("natsproxypath", a.NatsProxyPath, ns.proxyPath) || natsChanged
+	natsChanged = changed("natsproxyport", a.NatsProxyPort, ns.proxyPort) || natsChanged
+	natsChanged = changed("natspinginterval", a.NatsPingInterval, ns.pingInterval) || natsChanged
+	natsChanged = changed("natswscompression", a.NatsWSCompression, ns.wsCompression) || natsChanged
+	// the token and tls settings are used by nats as well
+	natsChanged = natsChanged || a.Token != ac.Token || a.Insecure != insecure
+
+	// unset temp dirs go back to the default like they do on startup
+	winTmpDir, winRunAsUserTmpDir := defaultWinTmpDir, defaultWinTmpDir
+	if len(ac.WinTmpDir) > 0 {
+		winTmpDir = ac.WinTmpDir
+	}
+	if len(ac.WinRunAsUserTmpDir) > 0 {
+		winRunAsUserTmpDir = ac.WinRunAsUserTmpDir
+	}
+	changed("wintmpdir", a.WinTmpDir, winTmpDir)
+	changed("winrunasusertmpdir", a.WinRunAsUserTmpDir, winRunAsUserTmpDir)
+
+	cfgMu.Lock()
+	a.WinTmpDir = winTmpDir
+	a.WinRunAsUserTmpDir = winRunAsUserTmpDir
+	if restChanged {
+		a.Headers = authHeaders(ac.Token)
+		a.rClient = newRestyClient(ac, a.Headers, a.Logger.IsLevelEnabled(logrus.DebugLevel))
+		a.BaseURL = ac.BaseURL
+		a.Token = ac.Token
+		a.Proxy = ac.Proxy
+		a.Cert = ac.Cert
+		a.Insecure = insecure
+	}
+	if natsChanged {
+		a.ApiURL = ac.APIURL
+		a.NatsServer = ns.server
+		a.NatsProxyPath = ns.proxyPath
+		a.NatsProxyPort = ns.proxyPort
+		a.NatsPingInterval = ns.pingInterval
+		a.NatsWSCompression = ns.wsCompression
+	}
+	cfgMu.Unlock()
+
+	if natsChanged {
+		reconnected, err := a.reconnectRPC()
+		if err != nil {
+			return ret, fmt.Errorf("config applied but nats could not reconnect, the previous connection is still in use: %w", err)
+		}
+		ret.Reconnected = reconnected
+	}
+
+	a.Logger.Infoln("Config reloaded, changed:", ret.Changed, "reconnected:", ret.Reconnected)
+	return ret, nil
+}
+
+// reconnectRPC moves the rpc subscription to a new nats connection built from the current settings.
+// It does nothing when RunRPC is not running in this process.
+func (a *Agent) reconnectRPC() (bool, error) {
+	rpcConn.Lock()
+	defer rpcConn.Unlock()
+
+	if rpcConn.router == nil {
+		return false, nil
+	}
+
+	nc, err := nats.Connect(a.settings().NatsServer, a.setupNatsOptions()...)
+	if err != nil {
+		return false, err
+	}
+	sub, err := a.subscribeRPC(nc, rpcConn.router)
+	if err != nil {
+		nc.Close()
+		return false, err
+	}
+	if err := nc.FlushTimeout(15 * time.Second); err != nil {
+		nc.Close()
+		return false, err
+	}
+
+	oldConn, oldSub := rpcConn.nc, rpcConn.sub
+	rpcConn.nc, rpcConn.sub = nc, sub
+
+	if oldSub != nil {
+		oldSub.Unsubscribe()
+	}
+	go a.closeWhenIdle(oldConn, rpcConn.router.pool)
+	return true, nil
+}
+
+// closeWhenIdle keeps a replaced connection open so rpcs that are still running can reply on it
+func (a *Agent) closeWhenIdle(nc *nats.Conn, pool *rpcPool) {
+	if nc == nil {
+		return
+	}
+	deadline := time.Now().Add(oldConnMaxWait)
+	for pool.busy() && time.Now().Before(deadline) {
+		time.Sleep(oldConnPollInterval)
+	}
+	a.Logger.Debugln("Closing the previous nats connection")
+	nc.Close()
+}
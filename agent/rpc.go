@@ -13,6 +13,7 @@ package agent
 
 import (
 	"fmt"
+	"net/http"
 	"os"
 	"runtime"
 	"strconv"
@@ -22,7 +23,7 @@ import (
 
 	rmm "github.com/amidaware/rmmagent/shared"
 	nats "github.com/nats-io/nats.go"
-	"github.com/ugorji/go/codec"
+	trmm "github.com/wh1te909/trmm-shared"
 )
 
 type NatsMsg struct {
@@ -44,6 +45,7 @@ type NatsMsg struct {
 	EnvVars                []string          `json:"env_vars"`
 	NushellEnableConfig    bool              `json:"nushell_enable_config"`
 	DenoDefaultPermissions string            `json:"deno_default_permissions"`
+	StreamSubject          string            `json:"stream_subject"`
 }
 
 var (
@@ -56,485 +58,465 @@ func (a *Agent) RunRPC() {
 	a.Logger.Infoln("Agent service started")
 
 	opts := a.setupNatsOptions()
-	nc, err := nats.Connect(a.NatsServer, opts...)
+	nc, err := nats.Connect(a.settings().NatsServer, opts...)
 	a.Logger.Debugf("%+v\n", nc)
 	a.Logger.Debugf("%+v\n", nc.Opts)
 	if err != nil {
 		a.Logger.Fatalln("RunRPC() nats.Connect()", err)
 	}
 
-	go a.RunAsService(nc)
+	router := a.newAgentRPCRouter()
+	sub, err := a.subscribeRPC(nc, router)
+	if err != nil {
+		a.Logger.Fatalln("RunRPC() subscribe", err)
+	}
+	rpcConn.Lock()
+	rpcConn.nc, rpcConn.sub, rpcConn.router = nc, sub, router
+	rpcConn.Unlock()
+
+	go a.RunAsService()
+	go a.reloadOnSignal()
+	if runtime.GOOS != "windows" {
+		go a.RunLocalAPI()
+	}
 
 	var wg sync.WaitGroup
 	wg.Add(1)
 
-	nc.Subscribe(a.AgentID, func(msg *nats.Msg) {
-		var payload *NatsMsg
-		var mh codec.MsgpackHandle
-		mh.RawToString = true
+	nc.Flush()
 
-		dec := codec.NewDecoderBytes(msg.Data, &mh)
-		if err := dec.Decode(&payload); err != nil {
-			a.Logger.Errorln(err)
-			return
-		}
+	if err := nc.LastError(); err != nil {
+		a.Logger.Errorln(err)
+		os.Exit(1)
+	}
 
-		switch payload.Func {
-		case "ping":
-			go func() {
-				var resp []byte
-				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
-				a.Logger.Debugln("pong")
-				ret.Encode("pong")
-				msg.Respond(resp)
-			}()
-
-		case "patchmgmt":
-			go func(p *NatsMsg) {
-				var resp []byte
-				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
-				err := a.PatchMgmnt(p.PatchMgmt)
-				if err != nil {
-					a.Logger.Errorln("PatchMgmnt:", err.Error())
-					ret.Encode(err.Error())
-				} else {
-					ret.Encode("ok")
-				}
-				msg.Respond(resp)
-			}(payload)
-
-		case "schedtask":
-			go func(p *NatsMsg) {
-				var resp []byte
-				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
-				success, err := a.CreateSchedTask(p.ScheduledTask)
-				if err != nil {
-					a.Logger.Errorln(err.Error())
-					ret.Encode(err.Error())
-				} else if !success {
-					ret.Encode("Something went wrong")
-				} else {
-					ret.Encode("ok")
-				}
-				msg.Respond(resp)
-			}(payload)
-
-		case "delschedtask":
-			go func(p *NatsMsg) {
-				var resp []byte
-				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
-				err := DeleteSchedTask(p.ScheduledTask.Name)
-				if err != nil {
-					a.Logger.Errorln(err.Error())
-					ret.Encode(err.Error())
-				} else {
-					ret.Encode("ok")
-				}
-				msg.Respond(resp)
-			}(payload)
-
-		case "listschedtasks":
-			go func() {
-				var resp []byte
-				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
-				tasks := ListSchedTasks()
-				a.Logger.Debugln(tasks)
-				ret.Encode(tasks)
-				msg.Respond(resp)
-			}()
-
-		case "eventlog":
-			go func(p *NatsMsg) {
-				var resp []byte
-				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
-				days, _ := strconv.Atoi(p.Data["days"])
-				evtLog := a.GetEventLog(p.Data["logname"], days)
-				a.Logger.Debugln(evtLog)
-				ret.Encode(evtLog)
-				msg.Respond(resp)
-			}(payload)
-
-		case "procs":
-			go func() {
-				var resp []byte
-				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
-				procs := a.GetProcsRPC()
-				a.Logger.Debugln(procs)
-				ret.Encode(procs)
-				msg.Respond(resp)
-			}()
-
-		case "killproc":
-			go func(p *NatsMsg) {
-				var resp []byte
-				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
-				err := KillProc(p.ProcPID)
-				if err != nil {
-					ret.Encode(err.Error())
-					a.Logger.Debugln(err.Error())
-				} else {
-					ret.Encode("ok")
-				}
-				msg.Respond(resp)
-			}(payload)
-
-		case "rawcmd":
-			go func(p *NatsMsg) {
-				var resp []byte
-				var resultData rmm.RawCMDResp
-				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
-
-				switch runtime.GOOS {
-				case "windows":
-					out, _ := CMDShell(p.Data["shell"], []string{}, p.Data["command"], p.Timeout, false, p.RunAsUser)
-					a.Logger.Debugln(out)
-					if out[1] != "" {
-						ret.Encode(out[1])
-						resultData.Results = out[1]
-					} else {
-						ret.Encode(out[0])
-						resultData.Results = out[0]
-					}
-				default:
-					opts := a.NewCMDOpts()
-					opts.Shell = p.Data["shell"]
-					opts.Command = p.Data["command"]
-					opts.Timeout = time.Duration(p.Timeout)
-					out := a.CmdV2(opts)
-					tmp := ""
-					if len(out.Stdout) > 0 {
-						tmp += out.Stdout
-					}
-					if len(out.Stderr) > 0 {
-						tmp += "\n"
-						tmp += out.Stderr
-					}
-					ret.Encode(tmp)
-					resultData.Results = tmp
-				}
+	wg.Wait()
+}
 
-				msg.Respond(resp)
-				if p.ID != 0 {
-					a.rClient.R().SetBody(resultData).Patch(fmt.Sprintf("/api/v3/%d/%s/histresult/", p.ID, a.AgentID))
-				}
-			}(payload)
-
-		case "winservices":
-			go func() {
-				var resp []byte
-				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
-				svcs := a.GetServices()
-				a.Logger.Debugln(svcs)
-				ret.Encode(svcs)
-				msg.Respond(resp)
-			}()
-
-		case "winsvcdetail":
-			go func(p *NatsMsg) {
-				var resp []byte
-				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
-				svc := a.GetServiceDetail(p.Data["name"])
-				a.Logger.Debugln(svc)
-				ret.Encode(svc)
-				msg.Respond(resp)
-			}(payload)
-
-		case "winsvcaction":
-			go func(p *NatsMsg) {
-				var resp []byte
-				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
-				retData := a.ControlService(p.Data["name"], p.Data["action"])
-				a.Logger.Debugln(retData)
-				ret.Encode(retData)
-				msg.Respond(resp)
-			}(payload)
-
-		case "editwinsvc":
-			go func(p *NatsMsg) {
-				var resp []byte
-				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
-				retData := a.EditService(p.Data["name"], p.Data["startType"])
-				a.Logger.Debugln(retData)
-				ret.Encode(retData)
-				msg.Respond(resp)
-			}(payload)
-
-		case "runscript":
-			go func(p *NatsMsg) {
-				var resp []byte
-				var retData string
-				var resultData rmm.RunScriptResp
-				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
-				start := time.Now()
-				stdout, stderr, retcode, err := a.RunScript(p.Data["code"], p.Data["shell"], p.ScriptArgs, p.Timeout, p.RunAsUser, p.EnvVars, p.NushellEnableConfig, p.DenoDefaultPermissions)
-				resultData.ExecTime = time.Since(start).Seconds()
-				resultData.ID = p.ID
-
-				if err != nil {
-					a.Logger.Debugln(err)
-					retData = err.Error()
-					resultData.Retcode = 1
-					resultData.Stderr = err.Error()
-				} else {
-					retData = stdout + stderr // to keep backwards compat
-					resultData.Retcode = retcode
-					resultData.Stdout = stdout
-					resultData.Stderr = stderr
-				}
-				a.Logger.Debugln(retData)
-				ret.Encode(retData)
-				msg.Respond(resp)
-				if p.ID != 0 {
-					results := map[string]interface{}{"script_results": resultData}
-					a.rClient.R().SetBody(results).Patch(fmt.Sprintf("/api/v3/%d/%s/histresult/", p.ID, a.AgentID))
-				}
-			}(payload)
-
-		case "runscriptfull":
-			go func(p *NatsMsg) {
-				var resp []byte
-				var retData rmm.RunScriptResp
-				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
-				start := time.Now()
-				stdout, stderr, retcode, err := a.RunScript(p.Data["code"], p.Data["shell"], p.ScriptArgs, p.Timeout, p.RunAsUser, p.EnvVars, p.NushellEnableConfig, p.DenoDefaultPermissions)
-
-				retData.ExecTime = time.Since(start).Seconds()
-				if err != nil {
-					retData.Stderr = err.Error()
-					retData.Retcode = 1
-				} else {
-					retData.Stdout = stdout
-					retData.Stderr = stderr
-					retData.Retcode = retcode
-				}
-				retData.ID = p.ID
-				a.Logger.Debugln(retData)
-				ret.Encode(retData)
-				msg.Respond(resp)
-				if p.ID != 0 {
-					results := map[string]interface{}{"script_results": retData}
-					a.rClient.R().SetBody(results).Patch(fmt.Sprintf("/api/v3/%d/%s/histresult/", p.ID, a.AgentID))
-				}
-			}(payload)
+// newAgentRPCRouter registers every function the rmm can call over nats
+func (a *Agent) newAgentRPCRouter() *rpcRouter {
+	rr := newRPCRouter(a)
 
-		case "recover":
-			go func(p *NatsMsg) {
-				var resp []byte
-				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
+	rr.register("ping", rpcFunc(rpcControl, 10*time.Second, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		a.Logger.Debugln("pong")
+		return "pong", nil
+	}))
 
-				switch p.Data["mode"] {
-				case "mesh":
-					a.Logger.Debugln("Recovering mesh")
-					a.RecoverMesh()
-				}
+	rr.register("rpcstats", rpcFunc(rpcControl, 10*time.Second, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		return rr.pool.Stats(), nil
+	}))
 
-				ret.Encode("ok")
-				msg.Respond(resp)
-			}(payload)
-		case "softwarelist":
-			go func() {
-				var resp []byte
-				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
-				sw := a.GetInstalledSoftware()
-				a.Logger.Debugln(sw)
-				ret.Encode(sw)
-				msg.Respond(resp)
-			}()
-
-		case "shutdown":
-			go func() {
-				a.Logger.Debugln("Scheduling immediate shutdown")
-				var resp []byte
-				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
-				ret.Encode("ok")
-				msg.Respond(resp)
-				if runtime.GOOS == "windows" {
-					CMD("shutdown.exe", []string{"/s", "/t", "5", "/f"}, 15, false)
-				} else {
-					opts := a.NewCMDOpts()
-					opts.Command = "shutdown -h now"
-					a.CmdV2(opts)
-				}
-			}()
-
-		case "rebootnow":
-			go func() {
-				a.Logger.Debugln("Scheduling immediate reboot")
-				var resp []byte
-				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
-				ret.Encode("ok")
-				msg.Respond(resp)
-				if runtime.GOOS == "windows" {
-					CMD("shutdown.exe", []string{"/r", "/t", "5", "/f"}, 15, false)
-				} else {
-					opts := a.NewCMDOpts()
-					opts.Command = "reboot"
-					a.CmdV2(opts)
-				}
-			}()
-		case "needsreboot":
-			go func() {
-				a.Logger.Debugln("Checking if reboot needed")
-				var resp []byte
-				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
-				out, err := a.SystemRebootRequired()
-				if err == nil {
-					a.Logger.Debugln("Reboot needed:", out)
-					ret.Encode(out)
-				} else {
-					a.Logger.Debugln("Error checking if reboot needed:", err)
-					ret.Encode(false)
-				}
-				msg.Respond(resp)
-			}()
-		case "sysinfo":
-			go func() {
-				var resp []byte
-				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
-				a.Logger.Debugln("Getting sysinfo with WMI")
-				modes := []string{"agent-agentinfo", "agent-disks", "agent-wmi", "agent-publicip"}
-				for _, m := range modes {
-					a.NatsMessage(nc, m)
-				}
-				ret.Encode("ok")
-				msg.Respond(resp)
-			}()
-		case "wmi":
-			go func() {
-				a.Logger.Debugln("Sending WMI")
-				a.NatsMessage(nc, "agent-wmi")
-			}()
-		case "cpuloadavg":
-			go func() {
-				var resp []byte
-				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
-				a.Logger.Debugln("Getting CPU Load Avg")
-				loadAvg := a.GetCPULoadAvg()
-				a.Logger.Debugln("CPU Load Avg:", loadAvg)
-				ret.Encode(loadAvg)
-				msg.Respond(resp)
-			}()
-		case "runchecks":
-			go func() {
-				var resp []byte
-				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
-				if runtime.GOOS == "windows" {
-					if a.ChecksRunning() {
-						ret.Encode("busy")
-						msg.Respond(resp)
-						a.Logger.Debugln("Checks are already running, please wait")
-					} else {
-						ret.Encode("ok")
-						msg.Respond(resp)
-						a.Logger.Debugln("Running checks")
-						_, checkerr := CMD(a.EXE, []string{"-m", "runchecks"}, 600, false)
-						if checkerr != nil {
-							a.Logger.Errorln("RPC RunChecks", checkerr)
-						}
-					}
-				} else {
-					ret.Encode("ok")
-					msg.Respond(resp)
-					a.Logger.Debugln("Running checks")
-					a.RunChecks(true)
-				}
+	rr.register("listjobs", rpcFunc(rpcControl, 10*time.Second, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		return runningJobs.List(), nil
+	}))
 
-			}()
-		case "runtask":
-			go func(p *NatsMsg) {
-				a.Logger.Debugln("Running task")
-				a.RunTask(p.TaskPK)
-			}(payload)
-
-		case "publicip":
-			go func() {
-				var resp []byte
-				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
-				ret.Encode(a.PublicIP())
-				msg.Respond(resp)
-			}()
-		case "installpython":
-			go a.GetPython(true)
-		case "installnushell":
-			go a.InstallNushell(true)
-		case "installdeno":
-			go a.InstallDeno(true)
-		case "installchoco":
-			go a.InstallChoco()
-		case "installwithchoco":
-			go func(p *NatsMsg) {
-				var resp []byte
-				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
-				ret.Encode("ok")
-				msg.Respond(resp)
-				out, _ := a.InstallWithChoco(p.ChocoProgName)
-				results := map[string]string{"results": out}
-				url := fmt.Sprintf("/api/v4/%s/%d/chocoresult/", a.AgentID, p.PendingActionPK)
-				a.rClient.R().SetBody(results).Patch(url)
-			}(payload)
-		case "getwinupdates":
-			go func() {
-				if !atomic.CompareAndSwapUint32(&getWinUpdateLocker, 0, 1) {
-					a.Logger.Debugln("Already checking for windows updates")
-				} else {
-					a.Logger.Debugln("Checking for windows updates")
-					defer atomic.StoreUint32(&getWinUpdateLocker, 0)
-					a.GetWinUpdates()
-				}
-			}()
-		case "installwinupdates":
-			go func(p *NatsMsg) {
-				if !atomic.CompareAndSwapUint32(&installWinUpdateLocker, 0, 1) {
-					a.Logger.Debugln("Already installing windows updates")
-				} else {
-					a.Logger.Debugln("Installing windows updates", p.UpdateGUIDs)
-					defer atomic.StoreUint32(&installWinUpdateLocker, 0)
-					a.InstallUpdates(p.UpdateGUIDs)
+	rr.register("canceljob", rpcFunc(rpcControl, 30*time.Second, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		id, err := strconv.Atoi(p.Data["job_id"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid job id %q", p.Data["job_id"])
+		}
+		if err := runningJobs.Cancel(id); err != nil {
+			return nil, err
+		}
+		return "ok", nil
+	}))
+
+	rr.register("reloadconfig", rpcFunc(rpcControl, 2*time.Minute, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		return a.ReloadConfig()
+	}))
+
+	rr.register("doctor", rpcFunc(rpcHeavy, 3*time.Minute, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		return a.RunDoctor(), nil
+	}).failWith(func(msg string) interface{} {
+		return DoctorReport{
+			AgentID: a.AgentID,
+			Version: a.Version,
+			Time:    time.Now(),
+			Checks:  []DoctorCheck{{Name: "doctor", Status: doctorFail, Detail: msg}},
+		}
+	}))
+
+	rr.register("patchmgmt", rpcFunc(rpcControl, 2*time.Minute, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		if err := a.PatchMgmnt(p.PatchMgmt); err != nil {
+			return nil, err
+		}
+		return "ok", nil
+	}))
+
+	rr.register("schedtask", rpcFunc(rpcControl, 2*time.Minute, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		success, err := a.CreateSchedTask(p.ScheduledTask)
+		if err != nil {
+			return nil, err
+		} else if !success {
+			return "Something went wrong", nil
+		}
+		return "ok", nil
+	}))
+
+	rr.register("delschedtask", rpcFunc(rpcControl, 2*time.Minute, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		if err := DeleteSchedTask(p.ScheduledTask.Name); err != nil {
+			return nil, err
+		}
+		return "ok", nil
+	}))
+
+	rr.register("listschedtasks", rpcFunc(rpcControl, 2*time.Minute, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		tasks := ListSchedTasks()
+		a.Logger.Debugln(tasks)
+		return tasks, nil
+	}).failWith(func(string) interface{} { return []string{} }))
+
+	rr.register("eventlog", rpcFunc(rpcHeavy, 5*time.Minute, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		days, _ := strconv.Atoi(p.Data["days"])
+		evtLog := a.GetEventLog(p.Data["logname"], days)
+		a.Logger.Debugln(evtLog)
+		return evtLog, nil
+	}).failWith(func(string) interface{} { return []rmm.EventLogMsg{} }))
+
+	rr.register("procs", rpcFunc(rpcHeavy, 2*time.Minute, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		procs := a.GetProcsRPC()
+		a.Logger.Debugln(procs)
+		return procs, nil
+	}).failWith(func(string) interface{} { return []rmm.ProcessMsg{} }))
+
+	rr.register("killproc", rpcFunc(rpcControl, time.Minute, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		if err := KillProc(p.ProcPID); err != nil {
+			return nil, err
+		}
+		return "ok", nil
+	}))
+
+	rr.register("rawcmd", rpcFunc(rpcHeavy, 0, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		var resultData rmm.RawCMDResp
+		req, stream := a.scriptRequester(r, p)
+		start := time.Now()
+		retcode := 0
+
+		switch runtime.GOOS {
+		case "windows":
+			out, _ := cmdShell(req, p.Data["shell"], []string{}, p.Data["command"], p.Timeout, false, p.RunAsUser)
+			a.Logger.Debugln(out)
+			// CMDShell buffers everything, the stream only gets the output once the command exits
+			if req.Output != nil {
+				if out[0] != "" {
+					req.Output("stdout", out[0])
 				}
-			}(payload)
-		case "agentupdate":
-			go func(p *NatsMsg) {
-				var resp []byte
-				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
-				if !atomic.CompareAndSwapUint32(&agentUpdateLocker, 0, 1) {
-					a.Logger.Debugln("Agent update already running")
-					ret.Encode("updaterunning")
-					msg.Respond(resp)
-				} else {
-					ret.Encode("ok")
-					msg.Respond(resp)
-					err := a.AgentUpdate(p.Data["url"], p.Data["inno"], p.Data["version"])
-					if err != nil {
-						atomic.StoreUint32(&agentUpdateLocker, 0)
-						return
-					}
-					atomic.StoreUint32(&agentUpdateLocker, 0)
-					nc.Flush()
-					nc.Close()
-					a.ControlService(winSvcName, "stop")
-					os.Exit(0)
+				if out[1] != "" {
+					req.Output("stderr", out[1])
 				}
-			}(payload)
-
-		case "uninstall":
-			go func(p *NatsMsg) {
-				var resp []byte
-				ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
-				ret.Encode("ok")
-				msg.Respond(resp)
-				a.AgentUninstall(p.Code)
-				nc.Flush()
-				nc.Close()
-				os.Exit(0)
-			}(payload)
+			}
+			if out[1] != "" {
+				resultData.Results = out[1]
+			} else {
+				resultData.Results = out[0]
+			}
+		default:
+			opts := a.NewCMDOpts()
+			opts.Shell = p.Data["shell"]
+			opts.Command = p.Data["command"]
+			opts.Timeout = time.Duration(p.Timeout)
+			opts.Requester = req
+			out := a.CmdV2(opts)
+			retcode = out.Status.Exit
+			tmp := ""
+			if len(out.Stdout) > 0 {
+				tmp += out.Stdout
+			}
+			if len(out.Stderr) > 0 {
+				tmp += "\n"
+				tmp += out.Stderr
+			}
+			resultData.Results = tmp
 		}
-	})
-	nc.Flush()
 
-	if err := nc.LastError(); err != nil {
-		a.Logger.Errorln(err)
-		os.Exit(1)
-	}
+		if stream != nil {
+			stream.Finish(retcode, time.Since(start).Seconds())
+		}
+		r.Respond(resultData.Results)
+		if p.ID != 0 {
+			a.SendResult(a.restClient(), http.MethodPatch, fmt.Sprintf("/api/v3/%d/%s/histresult/", p.ID, a.AgentID), resultData, historyResultTTL)
+		}
+		return rpcNoReply, nil
+	}))
+
+	rr.register("winservices", rpcFunc(rpcHeavy, 2*time.Minute, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		svcs := a.GetServices()
+		a.Logger.Debugln(svcs)
+		return svcs, nil
+	}).failWith(func(string) interface{} { return []trmm.WindowsService{} }))
+
+	rr.register("winsvcdetail", rpcFunc(rpcControl, time.Minute, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		svc := a.GetServiceDetail(p.Data["name"])
+		a.Logger.Debugln(svc)
+		return svc, nil
+	}).failWith(func(string) interface{} { return trmm.WindowsService{} }))
+
+	rr.register("winsvcaction", rpcFunc(rpcControl, 2*time.Minute, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		retData := a.ControlService(p.Data["name"], p.Data["action"])
+		a.Logger.Debugln(retData)
+		return retData, nil
+	}).failWith(func(msg string) interface{} { return rmm.WinSvcResp{Success: false, ErrorMsg: msg} }))
+
+	rr.register("editwinsvc", rpcFunc(rpcControl, time.Minute, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		retData := a.EditService(p.Data["name"], p.Data["startType"])
+		a.Logger.Debugln(retData)
+		return retData, nil
+	}).failWith(func(msg string) interface{} { return rmm.WinSvcResp{Success: false, ErrorMsg: msg} }))
+
+	rr.register("runscript", rpcFunc(rpcHeavy, 0, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		var retData string
+		var resultData rmm.RunScriptResp
+		start := time.Now()
+		req, stream := a.scriptRequester(r, p)
+		stdout, stderr, retcode, err := a.runScript(req, p.Data["code"], p.Data["shell"], p.ScriptArgs, p.Timeout, p.RunAsUser, p.EnvVars, p.NushellEnableConfig, p.DenoDefaultPermissions)
+		resultData.ExecTime = time.Since(start).Seconds()
+		resultData.ID = p.ID
+
+		if err != nil {
+			a.Logger.Debugln(err)
+			retData = err.Error()
+			resultData.Retcode = 1
+			resultData.Stderr = err.Error()
+		} else {
+			stdout, resultData.Structured = parseScriptOutput(stdout)
+			retData = stdout + stderr // to keep backwards compat
+			resultData.Retcode = retcode
+			resultData.Stdout = stdout
+			resultData.Stderr = stderr
+		}
+		if stream != nil {
+			stream.Finish(resultData.Retcode, resultData.ExecTime)
+		}
+		a.Logger.Debugln(retData)
+		r.Respond(retData)
+		if p.ID != 0 {
+			results := map[string]interface{}{"script_results": resultData}
+			a.SendResult(a.restClient(), http.MethodPatch, fmt.Sprintf("/api/v3/%d/%s/histresult/", p.ID, a.AgentID), results, historyResultTTL)
+		}
+		return rpcNoReply, nil
+	}))
+
+	rr.register("runscriptfull", rpcFunc(rpcHeavy, 0, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		var retData rmm.RunScriptResp
+		start := time.Now()
+		req, stream := a.scriptRequester(r, p)
+		stdout, stderr, retcode, err := a.runScript(req, p.Data["code"], p.Data["shell"], p.ScriptArgs, p.Timeout, p.RunAsUser, p.EnvVars, p.NushellEnableConfig, p.DenoDefaultPermissions)
+
+		retData.ExecTime = time.Since(start).Seconds()
+		if err != nil {
+			retData.Stderr = err.Error()
+			retData.Retcode = 1
+		} else {
+			retData.Stdout, retData.Structured = parseScriptOutput(stdout)
+			retData.Stderr = stderr
+			retData.Retcode = retcode
+		}
+		retData.ID = p.ID
+		if stream != nil {
+			stream.Finish(retData.Retcode, retData.ExecTime)
+		}
+		a.Logger.Debugln(retData)
+		r.Respond(retData)
+		if p.ID != 0 {
+			results := map[string]interface{}{"script_results": retData}
+			a.SendResult(a.restClient(), http.MethodPatch, fmt.Sprintf("/api/v3/%d/%s/histresult/", p.ID, a.AgentID), results, historyResultTTL)
+		}
+		return rpcNoReply, nil
+	}))
+
+	rr.register("recover", rpcFunc(rpcControl, 10*time.Second, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		switch p.Data["mode"] {
+		case "mesh":
+			a.Logger.Debugln("Recovering mesh")
+			go a.RecoverMesh()
+		}
+		return "ok", nil
+	}))
+
+	rr.register("softwarelist", rpcFunc(rpcHeavy, 5*time.Minute, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		sw := a.GetInstalledSoftware()
+		a.Logger.Debugln(sw)
+		return sw, nil
+	}).failWith(func(string) interface{} { return []trmm.WinSoftwareList{} }))
+
+	rr.register("shutdown", rpcFunc(rpcControl, 10*time.Second, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		a.Logger.Debugln("Scheduling immediate shutdown")
+		r.Respond("ok")
+		go func() {
+			if runtime.GOOS == "windows" {
+				CMD("shutdown.exe", []string{"/s", "/t", "5", "/f"}, 15, false)
+			} else {
+				opts := a.NewCMDOpts()
+				opts.Command = "shutdown -h now"
+				a.CmdV2(opts)
+			}
+		}()
+		return rpcNoReply, nil
+	}))
+
+	rr.register("rebootnow", rpcFunc(rpcControl, 10*time.Second, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		a.Logger.Debugln("Scheduling immediate reboot")
+		r.Respond("ok")
+		go func() {
+			if runtime.GOOS == "windows" {
+				CMD("shutdown.exe", []string{"/r", "/t", "5", "/f"}, 15, false)
+			} else {
+				opts := a.NewCMDOpts()
+				opts.Command = "reboot"
+				a.CmdV2(opts)
+			}
+		}()
+		return rpcNoReply, nil
+	}))
+
+	rr.register("needsreboot", rpcFunc(rpcControl, time.Minute, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		a.Logger.Debugln("Checking if reboot needed")
+		out, err := a.SystemRebootRequired()
+		if err != nil {
+			a.Logger.Debugln("Error checking if reboot needed:", err)
+			return false, nil
+		}
+		a.Logger.Debugln("Reboot needed:", out)
+		return out, nil
+	}).failWith(func(string) interface{} { return false }))
+
+	rr.register("sysinfo", rpcFunc(rpcHeavy, 0, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		a.Logger.Debugln("Getting sysinfo with WMI")
+		modes := []string{"agent-agentinfo", "agent-disks", "agent-wmi", "agent-publicip"}
+		for _, m := range modes {
+			a.NatsMessage(r.nc, m)
+		}
+		return "ok", nil
+	}))
+
+	rr.register("wmi", rpcFunc(rpcHeavy, 0, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		a.Logger.Debugln("Sending WMI")
+		a.NatsMessage(r.nc, "agent-wmi")
+		return rpcNoReply, nil
+	}))
+
+	rr.register("cpuloadavg", rpcFunc(rpcControl, time.Minute, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		a.Logger.Debugln("Getting CPU Load Avg")
+		loadAvg := a.GetCPULoadAvg()
+		a.Logger.Debugln("CPU Load Avg:", loadAvg)
+		return loadAvg, nil
+	}))
+
+	rr.register("runchecks", rpcFunc(rpcControl, 10*time.Second, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		if runtime.GOOS == "windows" && a.ChecksRunning() {
+			a.Logger.Debugln("Checks are already running, please wait")
+			return "busy", nil
+		}
+		go a.forceRunChecks()
+		return "ok", nil
+	}))
+
+	rr.register("runtask", rpcFunc(rpcHeavy, 0, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		a.Logger.Debugln("Running task")
+		a.runTask(&JobRequester{Func: r.Func, MsgID: p.TaskPK}, p.TaskPK)
+		return rpcNoReply, nil
+	}))
+
+	rr.register("publicip", rpcFunc(rpcControl, time.Minute, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		return a.PublicIP(), nil
+	}))
+
+	rr.register("installpython", rpcFunc(rpcHeavy, 0, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		a.GetPython(true)
+		return rpcNoReply, nil
+	}))
+
+	rr.register("installnushell", rpcFunc(rpcHeavy, 0, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		a.InstallNushell(true)
+		return rpcNoReply, nil
+	}))
+
+	rr.register("installdeno", rpcFunc(rpcHeavy, 0, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		a.InstallDeno(true)
+		return rpcNoReply, nil
+	}))
+
+	rr.register("installchoco", rpcFunc(rpcHeavy, 0, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		a.InstallChoco()
+		return rpcNoReply, nil
+	}))
+
+	rr.register("installwithchoco", rpcFunc(rpcHeavy, 0, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		r.Respond("ok")
+		out, _ := a.InstallWithChoco(p.ChocoProgName)
+		results := map[string]string{"results": out}
+		url := fmt.Sprintf("/api/v4/%s/%d/chocoresult/", a.AgentID, p.PendingActionPK)
+		a.SendResult(a.restClient(), http.MethodPatch, url, results, historyResultTTL)
+		return rpcNoReply, nil
+	}))
+
+	rr.register("getwinupdates", rpcFunc(rpcControl, 10*time.Second, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		if !atomic.CompareAndSwapUint32(&getWinUpdateLocker, 0, 1) {
+			a.Logger.Debugln("Already checking for windows updates")
+			return rpcNoReply, nil
+		}
+		a.Logger.Debugln("Checking for windows updates")
+		go func() {
+			defer atomic.StoreUint32(&getWinUpdateLocker, 0)
+			a.GetWinUpdates()
+		}()
+		return rpcNoReply, nil
+	}))
+
+	rr.register("installwinupdates", rpcFunc(rpcControl, 10*time.Second, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		if !atomic.CompareAndSwapUint32(&installWinUpdateLocker, 0, 1) {
+			a.Logger.Debugln("Already installing windows updates")
+			return rpcNoReply, nil
+		}
+		a.Logger.Debugln("Installing windows updates", p.UpdateGUIDs)
+		go func() {
+			defer atomic.StoreUint32(&installWinUpdateLocker, 0)
+			a.InstallUpdates(p.UpdateGUIDs)
+		}()
+		return rpcNoReply, nil
+	}))
+
+	rr.register("agentupdate", rpcFunc(rpcControl, 10*time.Second, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		if !atomic.CompareAndSwapUint32(&agentUpdateLocker, 0, 1) {
+			a.Logger.Debugln("Agent update already running")
+			return "updaterunning", nil
+		}
+		go func() {
+			err := a.AgentUpdate(p.Data["url"], p.Data["inno"], p.Data["version"])
+			atomic.StoreUint32(&agentUpdateLocker, 0)
+			if err != nil {
+				return
+			}
+			r.nc.Flush()
+			r.nc.Close()
+			a.ControlService(winSvcName, "stop")
+			os.Exit(0)
+		}()
+		return "ok", nil
+	}))
+
+	rr.register("uninstall", rpcFunc(rpcControl, 10*time.Second, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		r.Respond("ok")
+		go func() {
+			a.AgentUninstall(p.Code)
+			r.nc.Flush()
+			r.nc.Close()
+			os.Exit(0)
+		}()
+		return rpcNoReply, nil
+	}))
+
+	return rr
+}
 
-	wg.Wait()
+// scriptRequester identifies a script rpc in the job registry and streams its output
+// when the caller asked for it with a stream subject
+func (a *Agent) scriptRequester(r *rpcRequest, p *NatsMsg) (*JobRequester, *outputStreamer) {
+	req := &JobRequester{Func: r.Func, MsgID: p.ID}
+	if p.StreamSubject == "" || r.nc == nil {
+		return req, nil
+	}
+	stream := a.newOutputStreamer(r.nc, p.StreamSubject, p.ID)
+	req.Output = stream.Write
+	return req, stream
 }
@@ -0,0 +1,102 @@
+/*
+Copyright 2023 AmidaWare Inc.
+
+Licensed under the Tactical RMM License Version 1.0 (the “License”).
+You may only use the Licensed Software in accordance with the License.
+A copy of the License is available at:
+
+https://license.tacticalrmm.com
+
+*/
+
+package agent
+
+import (
+	"sync/atomic"
+)
+
+// rpcLane is a fixed number of workers draining a bounded queue
+type rpcLane struct {
+	class    rpcClass
+	workers  int
+	jobs     chan func()
+	inFlight int64
+}
+
+// rpcPool runs every rpc in the lane of its class so a burst of heavy jobs cannot starve control traffic
+type rpcPool struct {
+	lanes map[rpcClass]*rpcLane
+}
+
+type RPCLaneStats struct {
+	Lane     string `json:"lane"`
+	Workers  int    `json:"workers"`
+	Queued   int    `json:"queued"`
+	QueueCap int    `json:"queue_cap"`
+	InFlight int    `json:"in_flight"`
+}
+
+func newRPCPool(controlWorkers, controlQueue, heavyWorkers, heavyQueue int) *rpcPool {
+	p := &rpcPool{lanes: make(map[rpcClass]*rpcLane)}
+	p.addLane(rpcControl, controlWorkers, controlQueue)
+	p.addLane(rpcHeavy, heavyWorkers, heavyQueue)
+	return p
+}
+
+func (p *rpcPool) addLane(class rpcClass, workers, queue int) {
+	l := &rpcLane{class: class, workers: workers, jobs: make(chan func(), queue)}
+	for i := 0; i < workers; i++ {
+		go l.work()
+	}
+	p.lanes[class] = l
+}
+
+func (l *rpcLane) work() {
+	for job := range l.jobs {
+		atomic.AddInt64(&l.inFlight, 1)
+		job()
+		atomic.AddInt64(&l.inFlight, -1)
+	}
+}
+
+// submit queues fn in the lane of class, it returns false when the queue is full
+func (p *rpcPool) submit(class rpcClass, fn func()) bool {
+	l, ok := p.lanes[class]
+	if !ok {
+		l = p.lanes[rpcHeavy]
+	}
+	select {
+	case l.jobs <- fn:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *rpcPool) Stats() []RPCLaneStats {
+	ret := make([]RPCLaneStats, 0, len(p.lanes))
+	for _, class := range []rpcClass{rpcControl, rpcHeavy} {
+		l, ok := p.lanes[class]
+		if !ok {
+			continue
+		}
+		ret = append(ret, RPCLaneStats{
+			Lane:     class.String(),
+			Workers:  l.workers,
+			Queued:   len(l.jobs),
+			QueueCap: cap(l.jobs),
+			InFlight: int(atomic.LoadInt64(&l.inFlight)),
+		})
+	}
+	return ret
+}
+
+// busy reports whether any rpc is queued or running
+func (p *rpcPool) busy() bool {
+	for _, l := range p.lanes {
+		if len(l.jobs) > 0 || atomic.LoadInt64(&l.inFlight) > 0 {
+			return true
+		}
+	}
+	return false
+}
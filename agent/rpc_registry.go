@@ -0,0 +1,312 @@
+/*
+Copyright 2023 AmidaWare Inc.
+
+Licensed under the Tactical RMM License Version 1.0 (the “License”).
+You may only use the Licensed Software in accordance with the License.
+A copy of the License is available at:
+
+https://license.tacticalrmm.com
+
+*/
+
+package agent
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	rmm "github.com/amidaware/rmmagent/shared"
+	nats "github.com/nats-io/nats.go"
+	"github.com/ugorji/go/codec"
+)
+
+// rpcClass groups handlers by how expensive they are to run
+type rpcClass int
+
+const (
+	// rpcControl handlers are cheap and must stay responsive, e.g. ping
+	rpcControl rpcClass = iota
+	// rpcHeavy handlers run scripts or walk the whole system, e.g. runscript
+	rpcHeavy
+)
+
+func (c rpcClass) String() string {
+	switch c {
+	case rpcControl:
+		return "control"
+	case rpcHeavy:
+		return "heavy"
+	}
+	return "unknown"
+}
+
+const (
+	// nats servers default to 1MB when max_payload is not set
+	defaultMaxPayload = 1024 * 1024
+	// room for the msgpack framing of a ChunkPart
+	chunkOverhead = 1024
+)
+
+type noReply struct{}
+
+// rpcNoReply is returned by handlers that already responded or whose caller does not wait for a reply
+var rpcNoReply interface{} = noReply{}
+
+// rpcHandler is a registered nats function, build it with rpcFunc
+type rpcHandler struct {
+	class   rpcClass
+	timeout time.Duration // 0 waits for the handler forever
+	decode  func(data []byte) (interface{}, error)
+	handle  func(r *rpcRequest, payload interface{}) (interface{}, error)
+	// fail builds the reply when the handler errors, panics, times out or its lane is full,
+	// nil replies with the message as a string
+	fail func(msg string) interface{}
+}
+
+// failWith makes h reply with fn(msg) instead of a string when it cannot answer,
+// for callers that only decode the handler's result type
+func (h rpcHandler) failWith(fn func(msg string) interface{}) rpcHandler {
+	h.fail = fn
+	return h
+}
+
+func (h rpcHandler) failure(msg string) interface{} {
+	if h.fail == nil {
+		return msg
+	}
+	return h.fail(msg)
+}
+
+// rpcFunc builds a handler that receives the message decoded into a *T
+func rpcFunc[T any](class rpcClass, timeout time.Duration, fn func(r *rpcRequest, p *T) (interface{}, error)) rpcHandler {
+	return rpcHandler{
+		class:   class,
+		timeout: timeout,
+		decode: func(data []byte) (interface{}, error) {
+			p := new(T)
+			return p, decodeMsgpack(data, p)
+		},
+		handle: func(r *rpcRequest, payload interface{}) (interface{}, error) {
+			return fn(r, payload.(*T))
+		},
+	}
+}
+
+// rpcRequest is the handler side of a nats message
+type rpcRequest struct {
+	Func string
+	nc   *nats.Conn
+	// respond sends the reply, msg.Respond when coming from nats
+	respond func([]byte) error
+	// publish sends the parts of a chunked reply, nc.Publish when coming from nats
+	publish func(subject string, data []byte) error
+	// chunkSubject is where the caller listens for the parts of a response over the max payload
+	chunkSubject string
+	// failure is the handler's failure reply, see rpcHandler.fail
+	failure func(msg string) interface{}
+	once    sync.Once
+	a       *Agent
+}
+
+// Respond encodes v and sends it back to the caller, only the first call sends anything
+func (r *rpcRequest) Respond(v interface{}) {
+	r.once.Do(func() {
+		var resp []byte
+		ret := codec.NewEncoderBytes(&resp, new(codec.MsgpackHandle))
+		if err := ret.Encode(v); err != nil {
+			r.a.Logger.Errorln("rpc", r.Func, "encode:", err)
+			return
+		}
+		if limit := r.maxPayload(); len(resp) > limit {
+			if r.chunkSubject == "" || r.publish == nil {
+				r.a.Logger.Errorln("rpc", r.Func, "response is", len(resp), "bytes and the caller did not send a chunk_subject")
+				msg := fmt.Sprintf("%s response is %d bytes, over the %d byte max payload, send a chunk_subject to receive it in parts", r.Func, len(resp), limit)
+				var failure interface{} = msg
+				if r.failure != nil {
+					failure = r.failure(msg)
+				}
+				r.send(encodeMsgpack(failure))
+				return
+			}
+			r.respondChunked(resp, limit-chunkOverhead)
+			return
+		}
+		r.send(resp)
+	})
+}
+
+func (r *rpcRequest) send(resp []byte) error {
+	err := r.respond(resp)
+	if err != nil && !errors.Is(err, nats.ErrMsgNoReply) {
+		r.a.Logger.Debugln("rpc", r.Func, "respond:", err)
+	}
+	return err
+}
+
+func (r *rpcRequest) maxPayload() int {
+	if r.nc != nil {
+		if mp := r.nc.MaxPayload(); mp > 0 {
+			return int(mp)
+		}
+	}
+	return defaultMaxPayload
+}
+
+// respondChunked replies with a manifest and publishes the numbered parts of resp to the chunk subject,
+// a request-reply caller only receives the first reply so the parts cannot go to the reply subject.
+// The caller reassembles the parts in order and verifies the checksum before decoding.
+func (r *rpcRequest) respondChunked(resp []byte, chunkSize int) {
+	id := make([]byte, 8)
+	rand.Read(id)
+	sum := sha256.Sum256(resp)
+	manifest := rmm.ChunkManifest{
+		Chunked: true,
+		ID:      hex.EncodeToString(id),
+		Subject: r.chunkSubject,
+		Parts:   (len(resp) + chunkSize - 1) / chunkSize,
+		Size:    len(resp),
+		SHA256:  hex.EncodeToString(sum[:]),
+	}
+	r.a.Logger.Debugln("rpc", r.Func, "response is", len(resp), "bytes, sending", manifest.Parts, "chunks")
+
+	if err := r.send(encodeMsgpack(manifest)); err != nil {
+		return
+	}
+	for i := 0; i < manifest.Parts; i++ {
+		end := (i + 1) * chunkSize
+		if end > len(resp) {
+			end = len(resp)
+		}
+		part := rmm.ChunkPart{ID: manifest.ID, Part: i, Data: resp[i*chunkSize : end]}
+		if err := r.publish(r.chunkSubject, encodeMsgpack(part)); err != nil {
+			r.a.Logger.Debugln("rpc", r.Func, "chunk", i, err)
+			return
+		}
+	}
+}
+
+func encodeMsgpack(v interface{}) []byte {
+	var ret []byte
+	enc := codec.NewEncoderBytes(&ret, new(codec.MsgpackHandle))
+	enc.Encode(v)
+	return ret
+}
+
+func decodeMsgpack(data []byte, v interface{}) error {
+	var mh codec.MsgpackHandle
+	mh.RawToString = true
+	dec := codec.NewDecoderBytes(data, &mh)
+	return dec.Decode(v)
+}
+
+type rpcRouter struct {
+	a        *Agent
+	handlers map[string]rpcHandler
+	pool     *rpcPool
+}
+
+func newRPCRouter(a *Agent) *rpcRouter {
+	return &rpcRouter{
+		a:        a,
+		handlers: make(map[string]rpcHandler),
+		pool:     newRPCPool(a.RPCControlWorkers, a.RPCControlQueue, a.RPCWorkers, a.RPCQueueSize),
+	}
+}
+
+func (rr *rpcRouter) register(name string, h rpcHandler) {
+	if _, ok := rr.handlers[name]; ok {
+		panic(fmt.Sprintf("rpc handler %s registered twice", name))
+	}
+	rr.handlers[name] = h
+}
+
+// dispatch routes a raw nats message to its handler, nc may be nil outside of RunRPC
+func (rr *rpcRouter) dispatch(data []byte, nc *nats.Conn, respond func([]byte) error) {
+	r := &rpcRequest{nc: nc, respond: respond, a: rr.a}
+	if nc != nil {
+		r.publish = nc.Publish
+	}
+
+	var env struct {
+		Func         string `json:"func"`
+		ChunkSubject string `json:"chunk_subject"`
+	}
+	if err := decodeMsgpack(data, &env); err != nil {
+		rr.a.Logger.Errorln("rpc decode:", err)
+		r.Respond(fmt.Sprintf("invalid payload: %s", err))
+		return
+	}
+	r.Func = env.Func
+	r.chunkSubject = env.ChunkSubject
+
+	h, ok := rr.handlers[env.Func]
+	if !ok {
+		rr.a.Logger.Debugln("rpc unknown func:", env.Func)
+		r.Respond(fmt.Sprintf("unknown func: %s", env.Func))
+		return
+	}
+	r.failure = h.failure
+	if !rr.pool.submit(h.class, func() { rr.run(h, r, data) }) {
+		rr.a.Logger.Debugln("rpc", env.Func, "rejected, the", h.class, "lane is full")
+		r.Respond(h.failure("busy"))
+	}
+}
+
+// run decodes the payload, calls the handler and replies with its result or error
+func (rr *rpcRouter) run(h rpcHandler, r *rpcRequest, data []byte) {
+	start := time.Now()
+	rr.a.Logger.Debugln("rpc", r.Func, "started")
+
+	payload, err := h.decode(data)
+	if err != nil {
+		rr.a.Logger.Errorln("rpc", r.Func, "decode:", err)
+		r.Respond(fmt.Sprintf("invalid payload: %s", err))
+		return
+	}
+
+	type result struct {
+		ret interface{}
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if rec := recover(); rec != nil {
+				rr.a.Logger.Errorf("rpc %s panic: %v\n%s", r.Func, rec, debug.Stack())
+				done <- result{err: fmt.Errorf("%s panicked: %v", r.Func, rec)}
+			}
+		}()
+		ret, err := h.handle(r, payload)
+		done <- result{ret: ret, err: err}
+	}()
+
+	var timeout <-chan time.Time
+	if h.timeout > 0 {
+		timer := time.NewTimer(h.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case res := <-done:
+		switch {
+		case res.err != nil:
+			rr.a.Logger.Errorln("rpc", r.Func, res.err)
+			r.Respond(h.failure(res.err.Error()))
+		case res.ret != rpcNoReply:
+			r.Respond(res.ret)
+		}
+		rr.a.Logger.Debugln("rpc", r.Func, "finished in", time.Since(start))
+	case <-timeout:
+		// the caller stops waiting but the handler still holds its worker until it returns
+		rr.a.Logger.Errorln("rpc", r.Func, "timed out after", h.timeout)
+		r.Respond(h.failure(fmt.Sprintf("%s timed out after %s", r.Func, h.timeout)))
+		<-done
+	}
+}
@@ -0,0 +1,226 @@
+/*
+Copyright 2023 AmidaWare Inc.
+
+Licensed under the Tactical RMM License Version 1.0 (the “License”).
+You may only use the Licensed Software in accordance with the License.
+A copy of the License is available at:
+
+https://license.tacticalrmm.com
+
+*/
+
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	rmm "github.com/amidaware/rmmagent/shared"
+	"github.com/sirupsen/logrus"
+)
+
+func testAgent() *Agent {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return &Agent{
+		Logger:            logger,
+		AgentID:           "test-agent",
+		RPCWorkers:        1,
+		RPCQueueSize:      1,
+		RPCControlWorkers: 1,
+		RPCControlQueue:   1,
+	}
+}
+
+// call dispatches an rpc to rr like a nats message and returns the raw reply
+func call(t *testing.T, rr *rpcRouter, msg NatsMsg) []byte {
+	t.Helper()
+	reply := make(chan []byte, 1)
+	rr.dispatch(encodeMsgpack(msg), nil, func(b []byte) error {
+		reply <- b
+		return nil
+	})
+	select {
+	case b := <-reply:
+		return b
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s did not reply", msg.Func)
+	}
+	return nil
+}
+
+func TestRPCHandlers(t *testing.T) {
+	rr := testAgent().newAgentRPCRouter()
+
+	var pong string
+	if err := decodeMsgpack(call(t, rr, NatsMsg{Func: "ping"}), &pong); err != nil || pong != "pong" {
+		t.Fatalf("ping replied %q %v", pong, err)
+	}
+
+	var got string
+	if err := decodeMsgpack(call(t, rr, NatsMsg{Func: "nosuchfunc"}), &got); err != nil || got != "unknown func: nosuchfunc" {
+		t.Fatalf("unknown func replied %q %v", got, err)
+	}
+
+	msg := NatsMsg{Func: "canceljob", Data: map[string]string{"job_id": "abc"}}
+	if err := decodeMsgpack(call(t, rr, msg), &got); err != nil || !strings.Contains(got, "invalid job id") {
+		t.Fatalf("canceljob replied %q %v", got, err)
+	}
+
+	var stats []RPCLaneStats
+	if err := decodeMsgpack(call(t, rr, NatsMsg{Func: "rpcstats"}), &stats); err != nil || len(stats) != 2 {
+		t.Fatalf("rpcstats replied %+v %v", stats, err)
+	}
+}
+
+func TestRPCFailureKeepsResultType(t *testing.T) {
+	rr := newRPCRouter(testAgent())
+	release := make(chan struct{})
+	defer close(release)
+	emptyList := func(string) interface{} { return []rmm.ProcessMsg{} }
+
+	rr.register("slow", rpcFunc(rpcHeavy, 50*time.Millisecond, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		<-release
+		return []rmm.ProcessMsg{{Name: "late"}}, nil
+	}).failWith(emptyList))
+	rr.register("broken", rpcFunc(rpcControl, time.Second, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		panic("boom")
+	}).failWith(emptyList))
+	rr.register("failing", rpcFunc(rpcControl, time.Second, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		return nil, errors.New("it failed")
+	}))
+
+	for _, fn := range []string{"slow", "broken"} {
+		var procs []rmm.ProcessMsg
+		if err := decodeMsgpack(call(t, rr, NatsMsg{Func: fn}), &procs); err != nil || len(procs) != 0 {
+			t.Fatalf("%s replied %+v %v, want an empty list", fn, procs, err)
+		}
+	}
+
+	// the slow handler still holds the only heavy worker, the next one waits in the queue and the one after is rejected
+	rr.dispatch(encodeMsgpack(NatsMsg{Func: "slow"}), nil, func([]byte) error { return nil })
+	var procs []rmm.ProcessMsg
+	if err := decodeMsgpack(call(t, rr, NatsMsg{Func: "slow"}), &procs); err != nil || len(procs) != 0 {
+		t.Fatalf("busy replied %+v %v, want an empty list", procs, err)
+	}
+
+	var got string
+	if err := decodeMsgpack(call(t, rr, NatsMsg{Func: "failing"}), &got); err != nil || got != "it failed" {
+		t.Fatalf("failing replied %q %v", got, err)
+	}
+}
+
+func TestRespondChunked(t *testing.T) {
+	var replies [][]byte
+	published := make(map[string][][]byte)
+	r := &rpcRequest{
+		Func: "software",
+		a:    testAgent(),
+		respond: func(b []byte) error {
+			replies = append(replies, b)
+			return nil
+		},
+		publish: func(subject string, b []byte) error {
+			published[subject] = append(published[subject], b)
+			return nil
+		},
+		chunkSubject: "test-agent.chunks.1",
+	}
+
+	want := strings.Repeat("0123456789abcdef", 3*defaultMaxPayload/16)
+	r.Respond(want)
+
+	if len(replies) != 1 {
+		t.Fatalf("got %d replies, want only the manifest", len(replies))
+	}
+	var manifest rmm.ChunkManifest
+	if err := decodeMsgpack(replies[0], &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if !manifest.Chunked || manifest.Subject != r.chunkSubject || manifest.Parts < 3 {
+		t.Fatalf("bad manifest %+v", manifest)
+	}
+
+	parts := published[r.chunkSubject]
+	if len(parts) != manifest.Parts {
+		t.Fatalf("got %d parts, manifest says %d", len(parts), manifest.Parts)
+	}
+	buf := make([][]byte, manifest.Parts)
+	for _, b := range parts {
+		if len(b) > defaultMaxPayload {
+			t.Fatalf("part is %d bytes, over the max payload", len(b))
+		}
+		var part rmm.ChunkPart
+		if err := decodeMsgpack(b, &part); err != nil {
+			t.Fatal(err)
+		}
+		if part.ID != manifest.ID || part.Part < 0 || part.Part >= manifest.Parts || buf[part.Part] != nil {
+			t.Fatalf("bad part %d of %s", part.Part, part.ID)
+		}
+		buf[part.Part] = part.Data
+	}
+
+	var resp []byte
+	for _, b := range buf {
+		resp = append(resp, b...)
+	}
+	if len(resp) != manifest.Size {
+		t.Fatalf("reassembled %d bytes, manifest says %d", len(resp), manifest.Size)
+	}
+	sum := sha256.Sum256(resp)
+	if hex.EncodeToString(sum[:]) != manifest.SHA256 {
+		t.Fatal("checksum mismatch")
+	}
+	var got string
+	if err := decodeMsgpack(resp, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Fatal("reassembled response differs")
+	}
+}
+
+func TestRespondTooLargeWithoutChunkSubject(t *testing.T) {
+	var replies [][]byte
+	r := &rpcRequest{
+		Func: "software",
+		a:    testAgent(),
+		respond: func(b []byte) error {
+			replies = append(replies, b)
+			return nil
+		},
+	}
+	r.Respond(strings.Repeat("x", 2*defaultMaxPayload))
+
+	if len(replies) != 1 || len(replies[0]) > defaultMaxPayload {
+		t.Fatalf("got %d replies, want one small error", len(replies))
+	}
+	var got string
+	if err := decodeMsgpack(replies[0], &got); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(got, "chunk_subject") {
+		t.Fatalf("unexpected reply %q", got)
+	}
+}
+
+func TestRespondTooLargeKeepsResultType(t *testing.T) {
+	rr := newRPCRouter(testAgent())
+	rr.register("bigprocs", rpcFunc(rpcHeavy, time.Second, func(r *rpcRequest, p *NatsMsg) (interface{}, error) {
+		return []rmm.ProcessMsg{{Name: strings.Repeat("x", 2*defaultMaxPayload)}}, nil
+	}).failWith(func(string) interface{} { return []rmm.ProcessMsg{} }))
+
+	b := call(t, rr, NatsMsg{Func: "bigprocs"})
+	if len(b) > defaultMaxPayload {
+		t.Fatalf("reply is %d bytes, over the max payload", len(b))
+	}
+	var procs []rmm.ProcessMsg
+	if err := decodeMsgpack(b, &procs); err != nil || len(procs) != 0 {
+		t.Fatalf("got %+v %v, want an empty list", procs, err)
+	}
+}
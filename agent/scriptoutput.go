@@ -0,0 +1,80 @@
+/*
+Copyright 2023 AmidaWare Inc.
+
+Licensed under the Tactical RMM License Version 1.0 (the “License”).
+You may only use the Licensed Software in accordance with the License.
+A copy of the License is available at:
+
+https://license.tacticalrmm.com
+
+*/
+
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	rmm "github.com/amidaware/rmmagent/shared"
+)
+
+// scriptOutputMarker starts a line of structured output, e.g.
+//
+//	##trmm {"data": {"backup_size": 1234}}
+//	##trmm {"perf": [{"label": "queue", "value": 12, "warn": 50, "crit": 100}]}
+//	##trmm {"custom_fields": {"Last Backup": "2023-05-01"}}
+//
+// A script can print any number of these lines, they are merged in order.
+const scriptOutputMarker = "##trmm "
+
+// parseScriptOutput removes the structured output lines from stdout and returns them merged,
+// the returned ScriptOutput is nil if the script did not print any.
+// A marker line that is not valid json is left in stdout and reported in Errors.
+func parseScriptOutput(stdout string) (string, *rmm.ScriptOutput) {
+	if !strings.Contains(stdout, scriptOutputMarker) {
+		return stdout, nil
+	}
+
+	var ret *rmm.ScriptOutput
+	var clean strings.Builder
+	lines := strings.SplitAfter(stdout, "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, scriptOutputMarker) {
+			clean.WriteString(line)
+			continue
+		}
+
+		if ret == nil {
+			ret = &rmm.ScriptOutput{}
+		}
+		var out rmm.ScriptOutput
+		dec := json.NewDecoder(strings.NewReader(strings.TrimPrefix(trimmed, scriptOutputMarker)))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&out); err != nil {
+			ret.Errors = append(ret.Errors, fmt.Sprintf("line %d: %v", i+1, err))
+			clean.WriteString(line)
+			continue
+		}
+		mergeScriptOutput(ret, &out)
+	}
+	return clean.String(), ret
+}
+
+func mergeScriptOutput(dst, src *rmm.ScriptOutput) {
+	for k, v := range src.Data {
+		if dst.Data == nil {
+			dst.Data = make(map[string]interface{})
+		}
+		dst.Data[k] = v
+	}
+	dst.Perf = append(dst.Perf, src.Perf...)
+	for k, v := range src.CustomFields {
+		if dst.CustomFields == nil {
+			dst.CustomFields = make(map[string]string)
+		}
+		dst.CustomFields[k] = v
+	}
+	dst.Errors = append(dst.Errors, src.Errors...)
+}
@@ -0,0 +1,317 @@
+/*
+Copyright 2023 AmidaWare Inc.
+
+Licensed under the Tactical RMM License Version 1.0 (the “License”).
+You may only use the Licensed Software in accordance with the License.
+A copy of the License is available at:
+
+https://license.tacticalrmm.com
+
+*/
+
+package agent
+
+import (
+	"errors"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	rmm "github.com/amidaware/rmmagent/shared"
+	trmm "github.com/wh1te909/trmm-shared"
+)
+
+// properties requested from systemctl show for every service unit
+var systemdSvcProps = []string{"Id", "Description", "LoadState", "ActiveState", "UnitFileState", "MainPID", "ExecStart", "User"}
+
+// systemdBooted mirrors sd_booted(3), systemctl is useless on hosts that were not booted with systemd
+func systemdBooted() bool {
+	if _, err := exec.LookPath("systemctl"); err != nil {
+		return false
+	}
+	return trmm.FileExists("/run/systemd/system")
+}
+
+func (a *Agent) systemctl(args ...string) CmdStatus {
+	opts := a.NewCMDOpts()
+	opts.IsScript = true
+	opts.Shell = "systemctl"
+	opts.Args = append([]string{"--no-pager"}, args...)
+	return a.CmdV2(opts)
+}
+
+// systemdUnitName appends the .service suffix if the caller passed a bare name
+func systemdUnitName(name string) string {
+	if strings.Contains(name, ".") {
+		return name
+	}
+	return name + ".service"
+}
+
+// parseSystemctlShow parses the KEY=VALUE blocks printed by systemctl show, one block per unit
+func parseSystemctlShow(out string) []map[string]string {
+	ret := make([]map[string]string, 0)
+	cur := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			if len(cur) > 0 {
+				ret = append(ret, cur)
+				cur = make(map[string]string)
+			}
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		cur[k] = v
+	}
+	if len(cur) > 0 {
+		ret = append(ret, cur)
+	}
+	return ret
+}
+
+// execStartPath extracts the command line from systemd's ExecStart property
+// { path=/usr/sbin/sshd ; argv[]=/usr/sbin/sshd -D $SSHD_OPTS ; ignore_errors=no ; ... }
+func execStartPath(s string) string {
+	if i := strings.Index(s, "argv[]="); i != -1 {
+		argv := s[i+len("argv[]="):]
+		if j := strings.Index(argv, " ;"); j != -1 {
+			argv = argv[:j]
+		}
+		return strings.TrimSpace(argv)
+	}
+	if i := strings.Index(s, "path="); i != -1 {
+		p := s[i+len("path="):]
+		if j := strings.Index(p, " ;"); j != -1 {
+			p = p[:j]
+		}
+		return strings.TrimSpace(p)
+	}
+	return ""
+}
+
+// systemdStatusText maps systemd unit states to the windows service states the rmm expects
+func systemdStatusText(activeState string) string {
+	switch activeState {
+	case "active", "reloading":
+		return "running"
+	case "activating":
+		return "start_pending"
+	case "deactivating":
+		return "stop_pending"
+	case "inactive", "failed":
+		return "stopped"
+	default:
+		return "unknown"
+	}
+}
+
+// systemdStartType maps the unit file state to the windows service start types the rmm expects
+func systemdStartType(unitFileState string) string {
+	switch unitFileState {
+	case "enabled", "enabled-runtime", "linked", "linked-runtime", "alias":
+		return "Automatic"
+	case "disabled", "static", "indirect", "generated", "transient":
+		return "Manual"
+	case "masked", "masked-runtime", "bad":
+		return "Disabled"
+	default:
+		return "Unknown"
+	}
+}
+
+func systemdToWinSvc(props map[string]string) trmm.WindowsService {
+	pid, _ := strconv.ParseUint(props["MainPID"], 10, 32)
+	user := props["User"]
+	if user == "" {
+		user = "root"
+	}
+	desc := CleanString(props["Description"])
+	return trmm.WindowsService{
+		Name:        strings.TrimSuffix(props["Id"], ".service"),
+		Status:      systemdStatusText(props["ActiveState"]),
+		DisplayName: desc,
+		BinPath:     CleanString(execStartPath(props["ExecStart"])),
+		Description: desc,
+		Username:    CleanString(user),
+		PID:         uint32(pid),
+		StartType:   systemdStartType(props["UnitFileState"]),
+	}
+}
+
+func (a *Agent) systemdShow(units ...string) ([]map[string]string, error) {
+	args := []string{"show", "-p", strings.Join(systemdSvcProps, ",")}
+	args = append(args, units...)
+	out := a.systemctl(args...)
+	if out.Status.Error != nil {
+		return nil, out.Status.Error
+	}
+	if out.Status.Exit != 0 {
+		return nil, errors.New(strings.TrimSpace(out.Stderr))
+	}
+	return parseSystemctlShow(out.Stdout), nil
+}
+
+// systemdServiceUnits returns the names of all loaded and installed service units
+func (a *Agent) systemdServiceUnits() ([]string, error) {
+	seen := make(map[string]struct{})
+	ret := make([]string, 0)
+	add := func(name string) {
+		// templates cannot be queried or started without an instance name
+		if !strings.HasSuffix(name, ".service") || strings.HasSuffix(name, "@.service") {
+			return
+		}
+		if _, ok := seen[name]; ok {
+			return
+		}
+		seen[name] = struct{}{}
+		ret = append(ret, name)
+	}
+
+	units := a.systemctl("list-units", "--type=service", "--all", "--no-legend", "--plain")
+	if units.Status.Error != nil {
+		return ret, units.Status.Error
+	}
+	for _, line := range strings.Split(units.Stdout, "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			add(fields[0])
+		}
+	}
+
+	files := a.systemctl("list-unit-files", "--type=service", "--no-legend")
+	if files.Status.Error != nil {
+		return ret, files.Status.Error
+	}
+	for _, line := range strings.Split(files.Stdout, "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			add(fields[0])
+		}
+	}
+	return ret, nil
+}
+
+func GetServiceStatus(name string) (string, error) {
+	if !systemdBooted() {
+		return "n/a", errors.New("systemd is not running on this host")
+	}
+
+	out, err := exec.Command("systemctl", "show", "-p", "LoadState,ActiveState", systemdUnitName(name)).Output()
+	if err != nil {
+		return "n/a", err
+	}
+
+	units := parseSystemctlShow(string(out))
+	if len(units) == 0 || units[0]["LoadState"] == "not-found" {
+		return "n/a", errors.New("The specified service does not exist as an installed service.")
+	}
+	return systemdStatusText(units[0]["ActiveState"]), nil
+}
+
+// GetServices returns a list of systemd services
+func (a *Agent) GetServices() []trmm.WindowsService {
+	ret := make([]trmm.WindowsService, 0)
+	if !systemdBooted() {
+		a.Logger.Debugln("GetServices(): systemd is not running on this host")
+		return ret
+	}
+
+	names, err := a.systemdServiceUnits()
+	if err != nil {
+		a.Logger.Debugln("GetServices():", err)
+		return ret
+	}
+	if len(names) == 0 {
+		return ret
+	}
+
+	units, err := a.systemdShow(names...)
+	if err != nil {
+		a.Logger.Debugln("GetServices():", err)
+		return ret
+	}
+
+	for _, u := range units {
+		if u["LoadState"] == "not-found" || u["Id"] == "" {
+			continue
+		}
+		ret = append(ret, systemdToWinSvc(u))
+	}
+	return ret
+}
+
+func (a *Agent) GetServiceDetail(name string) trmm.WindowsService {
+	ret := trmm.WindowsService{}
+	if !systemdBooted() {
+		a.Logger.Errorln("GetServiceDetail(): systemd is not running on this host")
+		return ret
+	}
+
+	units, err := a.systemdShow(systemdUnitName(name))
+	if err != nil {
+		a.Logger.Errorln(err)
+		return ret
+	}
+	if len(units) == 0 || units[0]["LoadState"] == "not-found" {
+		a.Logger.Errorln("GetServiceDetail(): service not found:", name)
+		return ret
+	}
+	return systemdToWinSvc(units[0])
+}
+
+func (a *Agent) ControlService(name, action string) rmm.WinSvcResp {
+	if !systemdBooted() {
+		return rmm.WinSvcResp{Success: false, ErrorMsg: "systemd is not running on this host"}
+	}
+
+	switch action {
+	case "start", "stop", "restart":
+	default:
+		return rmm.WinSvcResp{Success: false, ErrorMsg: "Something went wrong"}
+	}
+
+	out := a.systemctl(action, systemdUnitName(name))
+	if out.Status.Error != nil {
+		return rmm.WinSvcResp{Success: false, ErrorMsg: out.Status.Error.Error()}
+	}
+	if out.Status.Exit != 0 {
+		return rmm.WinSvcResp{Success: false, ErrorMsg: strings.TrimSpace(out.Stderr)}
+	}
+	return rmm.WinSvcResp{Success: true, ErrorMsg: ""}
+}
+
+// EditService accepts the windows startup types sent by the rmm as well as the native systemctl verbs
+// auto/autodelay -> enable, manual -> disable, disabled -> mask
+func (a *Agent) EditService(name, startupType string) rmm.WinSvcResp {
+	if !systemdBooted() {
+		return rmm.WinSvcResp{Success: false, ErrorMsg: "systemd is not running on this host"}
+	}
+
+	var verbs []string
+	switch startupType {
+	case "auto", "autodelay", "enable":
+		verbs = []string{"unmask", "enable"}
+	case "manual", "disable":
+		verbs = []string{"unmask", "disable"}
+	case "disabled", "mask":
+		verbs = []string{"mask"}
+	case "unmask":
+		verbs = []string{"unmask"}
+	default:
+		return rmm.WinSvcResp{Success: false, ErrorMsg: "Unknown startup type provided"}
+	}
+
+	unit := systemdUnitName(name)
+	for _, verb := range verbs {
+		out := a.systemctl(verb, unit)
+		if out.Status.Error != nil {
+			return rmm.WinSvcResp{Success: false, ErrorMsg: out.Status.Error.Error()}
+		}
+		if out.Status.Exit != 0 {
+			return rmm.WinSvcResp{Success: false, ErrorMsg: strings.TrimSpace(out.Stderr)}
+		}
+	}
+	return rmm.WinSvcResp{Success: true, ErrorMsg: ""}
+}
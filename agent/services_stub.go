@@ -0,0 +1,34 @@
+//go:build !windows && !linux
+// +build !windows,!linux
+
+/*
+Copyright 2023 AmidaWare Inc.
+
+Licensed under the Tactical RMM License Version 1.0 (the “License”).
+You may only use the Licensed Software in accordance with the License.
+A copy of the License is available at:
+
+https://license.tacticalrmm.com
+
+*/
+
+package agent
+
+import (
+	rmm "github.com/amidaware/rmmagent/shared"
+	trmm "github.com/wh1te909/trmm-shared"
+)
+
+func GetServiceStatus(name string) (string, error) { return "", nil }
+
+func (a *Agent) GetServiceDetail(name string) trmm.WindowsService { return trmm.WindowsService{} }
+
+func (a *Agent) ControlService(name, action string) rmm.WinSvcResp {
+	return rmm.WinSvcResp{Success: false, ErrorMsg: "/na"}
+}
+
+func (a *Agent) EditService(name, startupType string) rmm.WinSvcResp {
+	return rmm.WinSvcResp{Success: false, ErrorMsg: "/na"}
+}
+
+func (a *Agent) GetServices() []trmm.WindowsService { return []trmm.WindowsService{} }
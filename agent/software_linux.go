@@ -0,0 +1,342 @@
+/*
+Copyright 2023 AmidaWare Inc.
+
+Licensed under the Tactical RMM License Version 1.0 (the “License”).
+You may only use the Licensed Software in accordance with the License.
+A copy of the License is available at:
+
+https://license.tacticalrmm.com
+
+*/
+
+package agent
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	trmm "github.com/wh1te909/trmm-shared"
+)
+
+const (
+	dpkgInfoDir      = "/var/lib/dpkg/info"
+	apkInstalledDB   = "/lib/apk/db/installed"
+	pacmanLocalDB    = "/var/lib/pacman/local"
+	snapdSnapsDir    = "/var/lib/snapd/snaps"
+	swListCmdTimeout = 120
+)
+
+type swBackend struct {
+	name   string
+	detect func() bool
+	list   func(a *Agent) ([]trmm.WinSoftwareList, error)
+}
+
+// every package manager found on the host is queried, a host can have e.g. dpkg + snap + flatpak
+var swBackends = []swBackend{
+	{name: "dpkg", detect: binExists("dpkg-query"), list: (*Agent).dpkgSoftware},
+	{name: "rpm", detect: binExists("rpm"), list: (*Agent).rpmSoftware},
+	{name: "apk", detect: func() bool { return trmm.FileExists(apkInstalledDB) }, list: (*Agent).apkSoftware},
+	{name: "pacman", detect: func() bool { return trmm.FileExists(pacmanLocalDB) }, list: (*Agent).pacmanSoftware},
+	{name: "snap", detect: binExists("snap"), list: (*Agent).snapSoftware},
+	{name: "flatpak", detect: binExists("flatpak"), list: (*Agent).flatpakSoftware},
+}
+
+func binExists(name string) func() bool {
+	return func() bool {
+		_, err := exec.LookPath(name)
+		return err == nil
+	}
+}
+
+func (a *Agent) GetInstalledSoftware() []trmm.WinSoftwareList {
+	ret := make([]trmm.WinSoftwareList, 0)
+	for _, b := range swBackends {
+		if !b.detect() {
+			continue
+		}
+		sw, err := b.list(a)
+		if err != nil {
+			a.Logger.Debugln("GetInstalledSoftware()", b.name, err)
+			continue
+		}
+		ret = append(ret, sw...)
+	}
+	return ret
+}
+
+func (a *Agent) SendSoftware() {
+	sw := a.GetInstalledSoftware()
+	a.Logger.Debugln(sw)
+
+	payload := map[string]interface{}{"agent_id": a.AgentID, "software": sw}
+	_, err := a.restClient().R().SetBody(payload).Post("/api/v3/software/")
+	if err != nil {
+		a.Logger.Debugln(err)
+	}
+}
+
+func swInstallDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf("%02d-%d-%02d", t.Year(), t.Month(), t.Day())
+}
+
+func unixStrToTime(s string) time.Time {
+	i, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || i <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(i, 0)
+}
+
+func byteStrToSize(s string, multiplier uint64) string {
+	i, err := strconv.ParseUint(strings.TrimSpace(s), 10, 64)
+	if err != nil || i == 0 {
+		return ""
+	}
+	return ByteCountSI(i * multiplier)
+}
+
+func (a *Agent) runSWListCmd(bin string, args ...string) (string, error) {
+	opts := a.NewCMDOpts()
+	opts.IsScript = true
+	opts.Shell = bin
+	opts.Args = args
+	opts.Timeout = swListCmdTimeout
+	out := a.CmdV2(opts)
+	if out.Status.Error != nil {
+		return "", out.Status.Error
+	}
+	if out.Status.Exit != 0 {
+		return "", fmt.Errorf("%s exited with code %d: %s", bin, out.Status.Exit, out.Stderr)
+	}
+	return out.Stdout, nil
+}
+
+func (a *Agent) dpkgSoftware() ([]trmm.WinSoftwareList, error) {
+	ret := make([]trmm.WinSoftwareList, 0)
+	out, err := a.runSWListCmd("dpkg-query", "-W", "-f=${db:Status-Abbrev}\t${Package}\t${Version}\t${Maintainer}\t${Installed-Size}\t${Architecture}\n")
+	if err != nil {
+		return ret, err
+	}
+
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 6 || !strings.HasPrefix(fields[0], "ii") {
+			continue
+		}
+		name, arch := fields[1], fields[5]
+
+		// dpkg touches the file list on every install/upgrade of the package
+		var installed time.Time
+		for _, list := range []string{name + ":" + arch + ".list", name + ".list"} {
+			if fi, err := os.Stat(filepath.Join(dpkgInfoDir, list)); err == nil {
+				installed = fi.ModTime()
+				break
+			}
+		}
+
+		ret = append(ret, trmm.WinSoftwareList{
+			Name:        CleanString(name),
+			Version:     CleanString(fields[2]),
+			Publisher:   CleanString(fields[3]),
+			InstallDate: swInstallDate(installed),
+			Size:        byteStrToSize(fields[4], 1024), // Installed-Size is in KiB
+			Source:      "dpkg",
+		})
+	}
+	return ret, nil
+}
+
+func (a *Agent) rpmSoftware() ([]trmm.WinSoftwareList, error) {
+	ret := make([]trmm.WinSoftwareList, 0)
+	out, err := a.runSWListCmd("rpm", "-qa", "--queryformat", "%{NAME}\t%{VERSION}-%{RELEASE}\t%{VENDOR}\t%{INSTALLTIME}\t%{SIZE}\n")
+	if err != nil {
+		return ret, err
+	}
+
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 5 || fields[0] == "gpg-pubkey" {
+			continue
+		}
+		vendor := fields[2]
+		if vendor == "(none)" {
+			vendor = ""
+		}
+		ret = append(ret, trmm.WinSoftwareList{
+			Name:        CleanString(fields[0]),
+			Version:     CleanString(fields[1]),
+			Publisher:   CleanString(vendor),
+			InstallDate: swInstallDate(unixStrToTime(fields[3])),
+			Size:        byteStrToSize(fields[4], 1),
+			Source:      "rpm",
+		})
+	}
+	return ret, nil
+}
+
+// apkSoftware parses the apk database directly, apk info cannot print all the fields we need in one call
+// https://wiki.alpinelinux.org/wiki/Apk_spec
+func (a *Agent) apkSoftware() ([]trmm.WinSoftwareList, error) {
+	ret := make([]trmm.WinSoftwareList, 0)
+	f, err := os.Open(apkInstalledDB)
+	if err != nil {
+		return ret, err
+	}
+	defer f.Close()
+
+	var cur trmm.WinSoftwareList
+	flush := func() {
+		if cur.Name != "" {
+			cur.Source = "apk"
+			ret = append(ret, cur)
+		}
+		cur = trmm.WinSoftwareList{}
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			flush()
+			continue
+		}
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch k {
+		case "P":
+			cur.Name = CleanString(v)
+		case "V":
+			cur.Version = CleanString(v)
+		case "m":
+			cur.Publisher = CleanString(v)
+		case "I":
+			cur.Size = byteStrToSize(v, 1)
+		case "t": // apk does not record the install time, use the build time instead
+			cur.InstallDate = swInstallDate(unixStrToTime(v))
+		}
+	}
+	flush()
+	return ret, scanner.Err()
+}
+
+// pacmanSoftware reads the desc file of every package in the local pacman database
+func (a *Agent) pacmanSoftware() ([]trmm.WinSoftwareList, error) {
+	ret := make([]trmm.WinSoftwareList, 0)
+	descs, err := filepath.Glob(filepath.Join(pacmanLocalDB, "*", "desc"))
+	if err != nil {
+		return ret, err
+	}
+
+	for _, desc := range descs {
+		content, err := os.ReadFile(desc)
+		if err != nil {
+			a.Logger.Debugln("pacmanSoftware()", err)
+			continue
+		}
+
+		// %SECTION%\nvalue\n...\n\n
+		fields := make(map[string]string)
+		var section string
+		for _, line := range strings.Split(string(content), "\n") {
+			if strings.HasPrefix(line, "%") && strings.HasSuffix(line, "%") {
+				section = strings.Trim(line, "%")
+				continue
+			}
+			if section != "" && line != "" {
+				if _, ok := fields[section]; !ok {
+					fields[section] = line
+				}
+			}
+		}
+		if fields["NAME"] == "" {
+			continue
+		}
+
+		ret = append(ret, trmm.WinSoftwareList{
+			Name:        CleanString(fields["NAME"]),
+			Version:     CleanString(fields["VERSION"]),
+			Publisher:   CleanString(fields["PACKAGER"]),
+			InstallDate: swInstallDate(unixStrToTime(fields["INSTALLDATE"])),
+			Size:        byteStrToSize(fields["SIZE"], 1),
+			Source:      "pacman",
+		})
+	}
+	return ret, nil
+}
+
+func (a *Agent) snapSoftware() ([]trmm.WinSoftwareList, error) {
+	ret := make([]trmm.WinSoftwareList, 0)
+	out, err := a.runSWListCmd("snap", "list", "--unicode=never", "--color=never")
+	if err != nil {
+		return ret, err
+	}
+
+	// Name  Version  Rev  Tracking  Publisher  Notes
+	for i, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if i == 0 || len(fields) < 5 {
+			continue
+		}
+		name, rev := fields[0], fields[2]
+		// verified publishers are suffixed with ** or a check mark
+		publisher := strings.TrimRight(fields[4], "*✓")
+
+		var installed time.Time
+		var size string
+		if fi, err := os.Stat(filepath.Join(snapdSnapsDir, fmt.Sprintf("%s_%s.snap", name, rev))); err == nil {
+			installed = fi.ModTime()
+			size = ByteCountSI(uint64(fi.Size()))
+		}
+
+		ret = append(ret, trmm.WinSoftwareList{
+			Name:        CleanString(name),
+			Version:     CleanString(fields[1]),
+			Publisher:   CleanString(publisher),
+			InstallDate: swInstallDate(installed),
+			Size:        size,
+			Source:      "snap",
+			Location:    filepath.Join("/snap", name, rev),
+		})
+	}
+	return ret, nil
+}
+
+func (a *Agent) flatpakSoftware() ([]trmm.WinSoftwareList, error) {
+	ret := make([]trmm.WinSoftwareList, 0)
+	out, err := a.runSWListCmd("flatpak", "list", "--app", "--columns=name,application,version,origin,installation,size")
+	if err != nil {
+		return ret, err
+	}
+
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 6 {
+			continue
+		}
+		name := fields[0]
+		if name == "" {
+			name = fields[1]
+		}
+		ret = append(ret, trmm.WinSoftwareList{
+			Name:      CleanString(name),
+			Version:   CleanString(fields[2]),
+			Publisher: CleanString(fields[3]),
+			Size:      CleanString(fields[5]),
+			Source:    "flatpak",
+			Location:  CleanString(fields[4]),
+		})
+	}
+	return ret, nil
+}
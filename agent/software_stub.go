@@ -0,0 +1,21 @@
+//go:build !windows && !linux
+// +build !windows,!linux
+
+/*
+Copyright 2023 AmidaWare Inc.
+
+Licensed under the Tactical RMM License Version 1.0 (the “License”).
+You may only use the Licensed Software in accordance with the License.
+A copy of the License is available at:
+
+https://license.tacticalrmm.com
+
+*/
+
+package agent
+
+import trmm "github.com/wh1te909/trmm-shared"
+
+func (a *Agent) GetInstalledSoftware() []trmm.WinSoftwareList { return []trmm.WinSoftwareList{} }
+
+func (a *Agent) SendSoftware() {}
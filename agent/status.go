@@ -0,0 +1,196 @@
+/*
+Copyright 2023 AmidaWare Inc.
+
+Licensed under the Tactical RMM License Version 1.0 (the “License”).
+You may only use the Licensed Software in accordance with the License.
+A copy of the License is available at:
+
+https://license.tacticalrmm.com
+
+*/
+
+package agent
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+// serviceState is what the running service remembers for -m status
+var serviceState = struct {
+	sync.Mutex
+	started       time.Time
+	checkins      map[string]time.Time
+	lastCheckRun  time.Time
+	lastCheckErr  string
+	lastReload    time.Time
+	lastReloadErr string
+}{
+	started:  time.Now(),
+	checkins: make(map[string]time.Time),
+}
+
+func recordCheckin(mode string) {
+	serviceState.Lock()
+	defer serviceState.Unlock()
+	serviceState.checkins[mode] = time.Now()
+}
+
+func recordCheckRun(err error) {
+	serviceState.Lock()
+	defer serviceState.Unlock()
+	serviceState.lastCheckRun = time.Now()
+	serviceState.lastCheckErr = ""
+	if err != nil {
+		serviceState.lastCheckErr = err.Error()
+	}
+}
+
+func recordReload(err error) {
+	serviceState.Lock()
+	defer serviceState.Unlock()
+	serviceState.lastReload = time.Now()
+	serviceState.lastReloadErr = ""
+	if err != nil {
+		serviceState.lastReloadErr = err.Error()
+	}
+}
+
+type NatsStatus struct {
+	Server     string `json:"server"`
+	Status     string `json:"status"`
+	RTT        int64  `json:"rtt_ms"`
+	Reconnects uint64 `json:"reconnects"`
+}
+
+type AgentStatus struct {
+	AgentID        string               `json:"agent_id"`
+	Version        string               `json:"version"`
+	PID            int                  `json:"pid"`
+	Started        time.Time            `json:"started"`
+	Nats           NatsStatus           `json:"nats"`
+	APIUnreachable bool                 `json:"api_unreachable"`
+	LastCheckin    map[string]time.Time `json:"last_checkin"`
+	LastCheckRun   time.Time            `json:"last_check_run"`
+	LastCheckError string               `json:"last_check_error"`
+	OutboxQueued   int                  `json:"outbox_queued"`
+	Jobs           []Job                `json:"jobs"`
+	RPC            []RPCLaneStats       `json:"rpc"`
+	ConfigSources  []string             `json:"config_sources"`
+	ConfigErrors   []string             `json:"config_errors"`
+	LastReload     time.Time            `json:"last_reload"`
+	LastReloadErr  string               `json:"last_reload_error"`
+}
+
+// Status returns the live state of the running service
+func (a *Agent) Status() AgentStatus {
+	ret := AgentStatus{
+		AgentID:        a.AgentID,
+		Version:        a.Version,
+		PID:            os.Getpid(),
+		APIUnreachable: isAPIUnreachable(),
+		LastCheckin:    make(map[string]time.Time),
+		OutboxQueued:   OutboxDepth(),
+		Jobs:           runningJobs.List(),
+		RPC:            []RPCLaneStats{},
+		ConfigErrors:   []string{},
+	}
+
+	serviceState.Lock()
+	ret.Started = serviceState.started
+	for mode, t := range serviceState.checkins {
+		ret.LastCheckin[mode] = t
+	}
+	ret.LastCheckRun = serviceState.lastCheckRun
+	ret.LastCheckError = serviceState.lastCheckErr
+	ret.LastReload = serviceState.lastReload
+	ret.LastReloadErr = serviceState.lastReloadErr
+	serviceState.Unlock()
+
+	ret.Nats = NatsStatus{Server: a.settings().NatsServer, Status: "NOT STARTED"}
+	rpcConn.RLock()
+	nc, router := rpcConn.nc, rpcConn.router
+	rpcConn.RUnlock()
+	if nc != nil {
+		ret.Nats.Status = nc.Status().String()
+		ret.Nats.Reconnects = nc.Stats().Reconnects
+		if nc.Status() == nats.CONNECTED {
+			if rtt, err := nc.RTT(); err == nil {
+				ret.Nats.RTT = rtt.Milliseconds()
+			}
+		}
+	}
+	if router != nil {
+		ret.RPC = router.pool.Stats()
+	}
+
+	var errs []error
+	ret.ConfigSources, errs = ConfigSources()
+	for _, err := range errs {
+		ret.ConfigErrors = append(ret.ConfigErrors, err.Error())
+	}
+	return ret
+}
+
+func since(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return fmt.Sprintf("%s (%v ago)", t.Format("2006-01-02 15:04:05"), time.Since(t).Round(time.Second))
+}
+
+// PrintStatus prints s for a person at the console
+func PrintStatus(s AgentStatus) {
+	fmt.Printf("Tactical RMM Agent %s, pid %d, up %v\n", s.Version, s.PID, time.Since(s.Started).Round(time.Second))
+	fmt.Println("Agent ID:", s.AgentID)
+	fmt.Printf("NATS:     %s %s, rtt %dms, %d reconnects\n", s.Nats.Status, s.Nats.Server, s.Nats.RTT, s.Nats.Reconnects)
+	if s.APIUnreachable {
+		fmt.Println("API:      unreachable, running cached checks")
+	} else {
+		fmt.Println("API:      reachable")
+	}
+	fmt.Println("Outbox:  ", s.OutboxQueued, "queued")
+
+	fmt.Println("Last check-in:")
+	modes := make([]string, 0, len(s.LastCheckin))
+	for mode := range s.LastCheckin {
+		modes = append(modes, mode)
+	}
+	sort.Strings(modes)
+	for _, mode := range modes {
+		fmt.Printf("  %-16s %s\n", mode, since(s.LastCheckin[mode]))
+	}
+	if len(modes) == 0 {
+		fmt.Println("  none yet")
+	}
+
+	fmt.Println("Last check run:", since(s.LastCheckRun))
+	if s.LastCheckError != "" {
+		fmt.Println("  error:", s.LastCheckError)
+	}
+
+	fmt.Println("Running jobs:", len(s.Jobs))
+	for _, j := range s.Jobs {
+		fmt.Printf("  %-4d %-12s pid %-7d %s  %s\n", j.ID, j.Func, j.PID, since(j.Started), j.Command)
+	}
+	for _, l := range s.RPC {
+		fmt.Printf("RPC %-8s %d/%d workers busy, %d/%d queued\n", l.Lane+":", l.InFlight, l.Workers, l.Queued, l.QueueCap)
+	}
+
+	fmt.Println("Config:", strings.Join(s.ConfigSources, ", "))
+	for _, e := range s.ConfigErrors {
+		fmt.Println("  error:", e)
+	}
+	if !s.LastReload.IsZero() {
+		fmt.Println("Last reload:", since(s.LastReload))
+		if s.LastReloadErr != "" {
+			fmt.Println("  error:", s.LastReloadErr)
+		}
+	}
+}
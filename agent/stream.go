@@ -0,0 +1,153 @@
+/*
+Copyright 2023 AmidaWare Inc.
+
+Licensed under the Tactical RMM License Version 1.0 (the “License”).
+You may only use the Licensed Software in accordance with the License.
+A copy of the License is available at:
+
+https://license.tacticalrmm.com
+
+*/
+
+package agent
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"time"
+
+	rmm "github.com/amidaware/rmmagent/shared"
+	nats "github.com/nats-io/nats.go"
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	// output is batched so a chatty script does not publish one message per line
+	streamFlushInterval = 500 * time.Millisecond
+	streamMaxChunk      = 32 * 1024
+)
+
+// outputStreamer publishes script output to a nats subject while the script runs
+type outputStreamer struct {
+	sync.Mutex
+	a       *Agent
+	nc      *nats.Conn
+	subject string
+	id      int
+	seq     int
+	stream  string
+	buf     strings.Builder
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func (a *Agent) newOutputStreamer(nc *nats.Conn, subject string, id int) *outputStreamer {
+	s := &outputStreamer{
+		a:       a,
+		nc:      nc,
+		subject: subject,
+		id:      id,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go s.flushLoop()
+	return s
+}
+
+func (s *outputStreamer) flushLoop() {
+	defer close(s.done)
+	ticker := time.NewTicker(streamFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Lock()
+			s.flush()
+			s.Unlock()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Write is a JobRequester.Output func
+func (s *outputStreamer) Write(stream, line string) {
+	s.Lock()
+	defer s.Unlock()
+	if s.stream != stream {
+		s.flush()
+		s.stream = stream
+	}
+	s.buf.WriteString(line)
+	s.buf.WriteString("\n")
+	if s.buf.Len() >= streamMaxChunk {
+		s.flush()
+	}
+}
+
+// flush must be called with the lock held
+func (s *outputStreamer) flush() {
+	if s.buf.Len() == 0 {
+		return
+	}
+	s.publish(rmm.ScriptStreamMsg{Stream: s.stream, Data: s.buf.String()})
+	s.buf.Reset()
+}
+
+func (s *outputStreamer) publish(m rmm.ScriptStreamMsg) {
+	s.seq++
+	m.ID = s.id
+	m.Seq = s.seq
+
+	var payload []byte
+	ret := codec.NewEncoderBytes(&payload, new(codec.MsgpackHandle))
+	if err := ret.Encode(m); err != nil {
+		s.a.Logger.Errorln("outputStreamer encode:", err)
+		return
+	}
+	if err := s.nc.Publish(s.subject, payload); err != nil {
+		s.a.Logger.Debugln("outputStreamer publish:", err)
+	}
+}
+
+// Finish flushes the remaining output and publishes the final status
+func (s *outputStreamer) Finish(retcode int, execTime float64) {
+	close(s.stop)
+	<-s.done
+
+	s.Lock()
+	defer s.Unlock()
+	s.flush()
+	s.publish(rmm.ScriptStreamMsg{Done: true, Retcode: retcode, ExecTime: execTime})
+	s.nc.Flush()
+}
+
+// lineWriter splits what is written to it into lines for a JobRequester.Output func
+type lineWriter struct {
+	stream string
+	output func(stream, line string)
+	buf    []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.output(w.stream, strings.TrimSuffix(string(w.buf[:i]), "\r"))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Close sends what is left after the last newline
+func (w *lineWriter) Close() error {
+	if len(w.buf) > 0 {
+		w.output(w.stream, string(w.buf))
+		w.buf = nil
+	}
+	return nil
+}
@@ -12,22 +12,25 @@ https://license.tacticalrmm.com
 package agent
 
 import (
+	"encoding/json"
 	"fmt"
 	"runtime"
 	"sync"
 	"time"
-
-	nats "github.com/nats-io/nats.go"
 )
 
-func (a *Agent) RunAsService(nc *nats.Conn) {
+func (a *Agent) RunAsService() {
 	var wg sync.WaitGroup
 	wg.Add(1)
-	go a.AgentSvc(nc)
+	go a.AgentSvc()
 	go a.CheckRunner()
+	go a.OutboxDrainer()
 	wg.Wait()
 }
 
+// checkInConfRefresh is how often AgentSvc re-fetches the check-in config to pick up changes made on the server
+const checkInConfRefresh = 30 * time.Minute
+
 type AgentCheckInConfig struct {
 	Hello                  int    `json:"checkin_hello"`
 	AgentInfo              int    `json:"checkin_agentinfo"`
@@ -48,7 +51,7 @@ type AgentCheckInConfig struct {
 	DenoDefaultPermissions string `json:"deno_default_permissions"`
 }
 
-func (a *Agent) AgentSvc(nc *nats.Conn) {
+func (a *Agent) AgentSvc() {
 	a.RunMigrations()
 
 	if runtime.GOOS == "windows" {
@@ -77,7 +80,7 @@ func (a *Agent) AgentSvc(nc *nats.Conn) {
 		if conf.LimitData && stringInSlice(s, limitNatsData) {
 			continue
 		} else {
-			a.NatsMessage(nc, s)
+			a.NatsMessage(currentNatsConn(), s)
 			time.Sleep(time.Duration(randRange(100, 400)) * time.Millisecond)
 		}
 	}
@@ -94,9 +97,14 @@ func (a *Agent) AgentSvc(nc *nats.Conn) {
 	go a.SyncMeshNodeID()
 
 	time.Sleep(time.Duration(randRange(1, 3)) * time.Second)
-	if runtime.GOOS == "windows" && !conf.LimitData {
-		a.AgentStartup()
-		a.SendSoftware()
+	if !conf.LimitData {
+		switch runtime.GOOS {
+		case "windows":
+			a.AgentStartup()
+			a.SendSoftware()
+		case "linux":
+			a.SendSoftware()
+		}
 	}
 
 	if runtime.GOOS == "darwin" {
@@ -111,25 +119,52 @@ func (a *Agent) AgentSvc(nc *nats.Conn) {
 	checkInSWTicker := time.NewTicker(time.Duration(conf.SW) * time.Second)
 	checkInWMITicker := time.NewTicker(time.Duration(conf.WMI) * time.Second)
 	syncMeshTicker := time.NewTicker(time.Duration(conf.SyncMesh) * time.Second)
+	checkInConfTicker := time.NewTicker(checkInConfRefresh)
 
 	for {
 		select {
 		case <-checkInHelloTicker.C:
-			a.NatsMessage(nc, "agent-hello")
+			a.NatsMessage(currentNatsConn(), "agent-hello")
 		case <-checkInAgentInfoTicker.C:
-			a.NatsMessage(nc, "agent-agentinfo")
+			a.NatsMessage(currentNatsConn(), "agent-agentinfo")
 		case <-checkInWinSvcTicker.C:
-			a.NatsMessage(nc, "agent-winsvc")
+			a.NatsMessage(currentNatsConn(), "agent-winsvc")
 		case <-checkInPubIPTicker.C:
-			a.NatsMessage(nc, "agent-publicip")
+			a.NatsMessage(currentNatsConn(), "agent-publicip")
 		case <-checkInDisksTicker.C:
-			a.NatsMessage(nc, "agent-disks")
+			a.NatsMessage(currentNatsConn(), "agent-disks")
 		case <-checkInSWTicker.C:
 			a.SendSoftware()
 		case <-checkInWMITicker.C:
-			a.NatsMessage(nc, "agent-wmi")
+			a.NatsMessage(currentNatsConn(), "agent-wmi")
 		case <-syncMeshTicker.C:
 			a.SyncMeshNodeID()
+		case <-checkInConfTicker.C:
+			fetched, err := a.fetchCheckInConf()
+			if err != nil {
+				a.Logger.Debugln("AgentSvc() refresh check-in config:", err)
+				continue
+			}
+			newConf := a.GetAgentCheckInConfig(fetched)
+			if newConf == conf {
+				continue
+			}
+			a.Logger.Debugf("AgentCheckInConf changed: %+v\n", newConf)
+			resetTicker(checkInHelloTicker, conf.Hello, newConf.Hello)
+			resetTicker(checkInAgentInfoTicker, conf.AgentInfo, newConf.AgentInfo)
+			resetTicker(checkInWinSvcTicker, conf.WinSvc, newConf.WinSvc)
+			resetTicker(checkInPubIPTicker, conf.PubIP, newConf.PubIP)
+			resetTicker(checkInDisksTicker, conf.Disks, newConf.Disks)
+			resetTicker(checkInSWTicker, conf.SW, newConf.SW)
+			resetTicker(checkInWMITicker, conf.WMI, newConf.WMI)
+			resetTicker(syncMeshTicker, conf.SyncMesh, newConf.SyncMesh)
+			if newConf.InstallNushell && !conf.InstallNushell {
+				go a.InstallNushell(false)
+			}
+			if newConf.InstallDeno && !conf.InstallDeno {
+				go a.InstallDeno(false)
+			}
+			conf = newConf
 		}
 	}
 }
@@ -137,53 +172,91 @@ func (a *Agent) AgentSvc(nc *nats.Conn) {
 func (a *Agent) AgentStartup() {
 	url := "/api/v3/checkin/"
 	payload := map[string]interface{}{"agent_id": a.AgentID}
-	_, err := a.rClient.R().SetBody(payload).Post(url)
+	_, err := a.restClient().R().SetBody(payload).Post(url)
 	if err != nil {
 		a.Logger.Debugln("AgentStartup()", err)
 	}
 }
 
-func (a *Agent) GetCheckInConfFromAPI() AgentCheckInConfig {
+// fetchCheckInConf gets the check-in config from the api and caches it to be used while the api is unreachable
+func (a *Agent) fetchCheckInConf() (AgentCheckInConfig, error) {
 	ret := AgentCheckInConfig{}
 	url := fmt.Sprintf("/api/v3/%s/config/", a.AgentID)
-	r, err := a.rClient.R().SetResult(&AgentCheckInConfig{}).Get(url)
+	r, err := a.restClient().R().SetResult(&AgentCheckInConfig{}).Get(url)
+	if err != nil {
+		return ret, err
+	}
+	if r.IsError() {
+		return ret, fmt.Errorf("%s: %s", r.Status(), r.String())
+	}
+
+	ret = *r.Result().(*AgentCheckInConfig)
+	if !ret.valid() {
+		return ret, fmt.Errorf("invalid check-in intervals: %+v", ret)
+	}
+
+	if b, err := json.Marshal(ret); err == nil {
+		if err := writeCache(checkInConfCacheFile, b); err != nil {
+			a.Logger.Debugln("fetchCheckInConf() writeCache:", err)
+		}
+	}
+	return ret, nil
+}
+
+// cachedCheckInConf returns the config from the last successful fetch
+func cachedCheckInConf() (AgentCheckInConfig, error) {
+	ret := AgentCheckInConfig{}
+	b, err := readCache(checkInConfCacheFile)
 	if err != nil {
-		a.Logger.Debugln("GetAgentCheckInConfig()", err)
-		ret.Hello = randRange(30, 60)
-		ret.AgentInfo = randRange(200, 400)
-		ret.WinSvc = randRange(2400, 3000)
-		ret.PubIP = randRange(300, 500)
-		ret.Disks = randRange(1000, 2000)
-		ret.SW = randRange(2800, 3500)
-		ret.WMI = randRange(3000, 4000)
-		ret.SyncMesh = randRange(800, 1200)
-		ret.LimitData = false
-		ret.InstallNushell = false
-		ret.InstallNushellVersion = ""
-		ret.InstallNushellUrl = ""
-		ret.NushellEnableConfig = false
-		ret.InstallDeno = false
-		ret.InstallDenoVersion = ""
-		ret.InstallDenoUrl = ""
-		ret.DenoDefaultPermissions = ""
-	} else {
-		ret.Hello = r.Result().(*AgentCheckInConfig).Hello
-		ret.AgentInfo = r.Result().(*AgentCheckInConfig).AgentInfo
-		ret.WinSvc = r.Result().(*AgentCheckInConfig).WinSvc
-		ret.PubIP = r.Result().(*AgentCheckInConfig).PubIP
-		ret.Disks = r.Result().(*AgentCheckInConfig).Disks
-		ret.SW = r.Result().(*AgentCheckInConfig).SW
-		ret.WMI = r.Result().(*AgentCheckInConfig).WMI
-		ret.SyncMesh = r.Result().(*AgentCheckInConfig).SyncMesh
-		ret.LimitData = r.Result().(*AgentCheckInConfig).LimitData
-		ret.InstallNushell = r.Result().(*AgentCheckInConfig).InstallNushell
-		ret.InstallNushellVersion = r.Result().(*AgentCheckInConfig).InstallNushellVersion
-		ret.InstallNushellUrl = r.Result().(*AgentCheckInConfig).InstallNushellUrl
-		ret.NushellEnableConfig = r.Result().(*AgentCheckInConfig).NushellEnableConfig
-		ret.InstallDeno = r.Result().(*AgentCheckInConfig).InstallDeno
-		ret.InstallDenoVersion = r.Result().(*AgentCheckInConfig).InstallDenoVersion
-		ret.InstallDenoUrl = r.Result().(*AgentCheckInConfig).InstallDenoUrl
-		ret.DenoDefaultPermissions = r.Result().(*AgentCheckInConfig).DenoDefaultPermissions
+		return ret, err
 	}
+	if err := json.Unmarshal(b, &ret); err != nil {
+		return ret, err
+	}
+	if !ret.valid() {
+		return ret, fmt.Errorf("invalid check-in intervals: %+v", ret)
+	}
+	return ret, nil
+}
+
+// valid reports whether every interval can be used for a ticker
+func (c AgentCheckInConfig) valid() bool {
+	for _, i := range []int{c.Hello, c.AgentInfo, c.WinSvc, c.PubIP, c.Disks, c.SW, c.WMI, c.SyncMesh} {
+		if i <= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *Agent) GetCheckInConfFromAPI() AgentCheckInConfig {
+	ret, err := a.fetchCheckInConf()
+	if err == nil {
+		return ret
+	}
+	a.Logger.Debugln("GetAgentCheckInConfig()", err)
+
+	// keep the behaviour the server configured last time instead of resetting it during an outage
+	if cached, cerr := cachedCheckInConf(); cerr == nil {
+		a.Logger.Debugln("GetAgentCheckInConfig() using cached config")
+		return cached
+	}
+
+	ret = AgentCheckInConfig{}
+	ret.Hello = randRange(30, 60)
+	ret.AgentInfo = randRange(200, 400)
+	ret.WinSvc = randRange(2400, 3000)
+	ret.PubIP = randRange(300, 500)
+	ret.Disks = randRange(1000, 2000)
+	ret.SW = randRange(2800, 3500)
+	ret.WMI = randRange(3000, 4000)
+	ret.SyncMesh = randRange(800, 1200)
 	return ret
 }
+
+// resetTicker applies a changed check-in interval
+func resetTicker(t *time.Ticker, old, cur int) {
+	if old != cur {
+		t.Reset(time.Duration(cur) * time.Second)
+	}
+}
@@ -0,0 +1,547 @@
+/*
+Copyright 2023 AmidaWare Inc.
+
+Licensed under the Tactical RMM License Version 1.0 (the “License”).
+You may only use the Licensed Software in accordance with the License.
+A copy of the License is available at:
+
+https://license.tacticalrmm.com
+
+*/
+
+package agent
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/rickb777/date/period"
+	trmm "github.com/wh1te909/trmm-shared"
+)
+
+// SchedTask mirrors the windows task scheduler payload, the taskmaster bitmask types are windows only
+// DaysOfWeek: Sunday = 1 ... Saturday = 64, DaysOfMonth: 1st = 1 ... 31st = 1<<30, last day = 1<<31
+// MonthsOfYear: January = 1 ... December = 2048, WeeksOfMonth: First = 1 ... Fourth = 8, LastWeek = 16
+type SchedTask struct {
+	PK                  int           `json:"pk"`
+	Type                string        `json:"type"`
+	Name                string        `json:"name"`
+	Trigger             string        `json:"trigger"`
+	Enabled             bool          `json:"enabled"`
+	DayInterval         uint8         `json:"day_interval"`
+	WeekInterval        uint8         `json:"week_interval"`
+	DaysOfWeek          uint16        `json:"days_of_week"`
+	DaysOfMonth         uint32        `json:"days_of_month"`
+	RunOnLastDayOfMonth bool          `json:"run_on_last_day_of_month"`
+	MonthsOfYear        uint16        `json:"months_of_year"`
+	WeeksOfMonth        uint8         `json:"weeks_of_month"`
+	StartYear           int           `json:"start_year"`
+	StartMonth          time.Month    `json:"start_month"`
+	StartDay            int           `json:"start_day"`
+	StartHour           int           `json:"start_hour"`
+	StartMinute         int           `json:"start_min"`
+	ExpireYear          int           `json:"expire_year"`
+	ExpireMonth         time.Month    `json:"expire_month"`
+	ExpireDay           int           `json:"expire_day"`
+	ExpireHour          int           `json:"expire_hour"`
+	ExpireMinute        int           `json:"expire_min"`
+	RandomDelay         period.Period `json:"random_delay"`
+	RepetitionInterval  period.Period `json:"repetition_interval"`
+	RepetitionDuration  period.Period `json:"repetition_duration"`
+	StopAtDurationEnd   bool          `json:"stop_at_duration_end"`
+	Path                string        `json:"path"`
+	WorkDir             string        `json:"workdir"`
+	Args                string        `json:"args"`
+	TaskPolicy          uint          `json:"multiple_instances"`
+	RunASAPAfterMissed  bool          `json:"start_when_available"`
+	DeleteAfter         bool          `json:"delete_expired_task_after"`
+	Overwrite           bool          `json:"overwrite_task"`
+}
+
+const (
+	systemdUnitDir     = "/etc/systemd/system"
+	cronDir            = "/etc/cron.d"
+	schedTaskPrefix    = "tacticalrmm-task-"
+	cronSchedTaskPrefx = "tacticalrmm_task_"
+	// first line of every unit and cron file created by the agent, holds the task name sent by the rmm
+	schedTaskMarker = "# tacticalrmm task: "
+
+	onboardingCronSchedule = "* * * * *"
+
+	lastDayOfMonthBit = 1 << 31
+	lastWeekBit       = 16
+)
+
+var schedTaskNameRegex = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+var weekDayNames = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+
+func schedTaskFileName(name string) string {
+	return schedTaskNameRegex.ReplaceAllString(name, "_")
+}
+
+func schedTaskUnit(name string) string {
+	return schedTaskPrefix + schedTaskFileName(name)
+}
+
+func schedTaskCronFile(name string) string {
+	return filepath.Join(cronDir, cronSchedTaskPrefx+schedTaskFileName(name))
+}
+
+// bitsToList returns the 1-based positions of the set bits, e.g. 0b101 -> [1 3]
+func bitsToList(mask uint64, bits int) []int {
+	ret := make([]int, 0)
+	for i := 0; i < bits; i++ {
+		if mask&(1<<i) != 0 {
+			ret = append(ret, i+1)
+		}
+	}
+	return ret
+}
+
+func joinInts(ints []int, format string) string {
+	s := make([]string, 0, len(ints))
+	for _, i := range ints {
+		s = append(s, fmt.Sprintf(format, i))
+	}
+	return strings.Join(s, ",")
+}
+
+// shellQuote single quotes s for /bin/sh
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// schedTaskCommand returns the shell command line the task runs
+func (a *Agent) schedTaskCommand(st SchedTask) (string, error) {
+	switch st.Type {
+	case "rmm":
+		self, err := os.Executable()
+		if err != nil {
+			self = nixAgentBin
+		}
+		return fmt.Sprintf("%s -m taskrunner -p %d", shellQuote(self), st.PK), nil
+	case "schedreboot":
+		return "/sbin/shutdown -r now", nil
+	case "custom":
+		if st.Path == "" {
+			return "", errors.New("custom task is missing a path")
+		}
+		cmd := shellQuote(st.Path)
+		if st.Args != "" {
+			cmd += " " + st.Args
+		}
+		if st.WorkDir != "" {
+			cmd = fmt.Sprintf("cd %s && %s", shellQuote(st.WorkDir), cmd)
+		}
+		return cmd, nil
+	}
+	return "", fmt.Errorf("unknown task type %s", st.Type)
+}
+
+// schedTaskGuards returns shell conditions that make a run exit early for the parts of the windows
+// trigger that neither systemd calendar events nor cron can express
+func schedTaskGuards(st SchedTask, cleanup string, isCron bool) []string {
+	ret := make([]string, 0)
+	loc := time.Now().Location()
+	start := time.Date(st.StartYear, st.StartMonth, st.StartDay, st.StartHour, st.StartMinute, 0, 0, loc)
+
+	if st.ExpireMinute != 0 || st.ExpireHour != 0 || st.ExpireYear != 0 {
+		expire := time.Date(st.ExpireYear, st.ExpireMonth, st.ExpireDay, st.ExpireHour, st.ExpireMinute, 0, 0, loc)
+		expired := "exit 0"
+		if st.DeleteAfter {
+			expired = cleanup + "; exit 0"
+		}
+		ret = append(ret, fmt.Sprintf(`if [ "$(date +%%s)" -ge %d ]; then %s; fi`, expire.Unix(), expired))
+	}
+
+	switch st.Trigger {
+	case "daily", "weekly", "monthly", "monthlydow":
+		if st.StartYear != 0 {
+			ret = append(ret, fmt.Sprintf(`[ "$(date +%%s)" -ge %d ] || exit 0`, start.Unix()))
+		}
+	}
+
+	// the repetitions keep firing after the duration, runs outside the window that starts at the trigger time exit.
+	// cron tasks cannot repeat, createCronTask rejects them
+	interval := int(st.RepetitionInterval.DurationApprox().Seconds())
+	duration := int(st.RepetitionDuration.DurationApprox().Seconds())
+	if !isCron && st.Trigger != "onboarding" && interval > 0 && duration > 0 && duration < 86400 {
+		startSec := st.StartHour*3600 + st.StartMinute*60
+		ret = append(ret, fmt.Sprintf(`[ $(( ($(date +%%s) - $(date -d 00:00 +%%s) - %d + 86400) %% 86400 )) -le %d ] || exit 0`, startSec, duration))
+	}
+
+	switch st.Trigger {
+	case "daily":
+		if st.DayInterval > 1 {
+			ret = append(ret, fmt.Sprintf(`[ $(( %s %% %d )) -eq 0 ] || exit 0`, localDaysSince(start), st.DayInterval))
+		}
+	case "weekly":
+		if st.WeekInterval > 1 {
+			// weeks start on sunday like the windows task scheduler counts them
+			weekStart := start.AddDate(0, 0, -int(start.Weekday()))
+			ret = append(ret, fmt.Sprintf(`[ $(( %s / 7 %% %d )) -eq 0 ] || exit 0`, localDaysSince(weekStart), st.WeekInterval))
+		}
+	case "monthly":
+		if isCron && (st.RunOnLastDayOfMonth || st.DaysOfMonth&lastDayOfMonthBit != 0) && st.DaysOfMonth&^lastDayOfMonthBit == 0 {
+			ret = append(ret, `[ "$(date -d tomorrow +%d)" = 01 ] || exit 0`)
+		}
+	case "monthlydow":
+		if isCron {
+			conds := make([]string, 0)
+			for _, w := range bitsToList(uint64(st.WeeksOfMonth), 5) {
+				if w == 5 {
+					conds = append(conds, `[ "$(date -d '+7 days' +%m)" != "$(date +%m)" ]`)
+				} else {
+					conds = append(conds, fmt.Sprintf(`[ $(( ($(date +%%-d) - 1) / 7 + 1 )) -eq %d ]`, w))
+				}
+			}
+			if len(conds) > 0 {
+				ret = append(ret, fmt.Sprintf("{ %s; } || exit 0", strings.Join(conds, " || ")))
+			}
+		}
+	}
+	return ret
+}
+
+// localDaysSince returns a shell arithmetic expression for the number of local calendar days from day to today.
+// Noon to noon is 23 to 25 hours across dst so the difference is rounded instead of cut.
+func localDaysSince(day time.Time) string {
+	noon := time.Date(day.Year(), day.Month(), day.Day(), 12, 0, 0, 0, day.Location())
+	return fmt.Sprintf(`( ($(date -d "$(date +%%F) 12:00" +%%s) - %d + 43200) / 86400 )`, noon.Unix())
+}
+
+// onCalendar translates the trigger into systemd calendar events, see systemd.time(7)
+func onCalendar(st SchedTask) ([]string, error) {
+	at := fmt.Sprintf("%02d:%02d:00", st.StartHour, st.StartMinute)
+	months := "*"
+	if m := bitsToList(uint64(st.MonthsOfYear), 12); len(m) > 0 && len(m) < 12 {
+		months = joinInts(m, "%02d")
+	}
+	days := make([]string, 0)
+	for _, d := range bitsToList(uint64(st.DaysOfWeek), 7) {
+		days = append(days, weekDayNames[d-1])
+	}
+	dow := ""
+	if len(days) > 0 && len(days) < 7 {
+		dow = strings.Join(days, ",") + " "
+	}
+
+	switch st.Trigger {
+	case "runonce":
+		return []string{fmt.Sprintf("%04d-%02d-%02d %s", st.StartYear, st.StartMonth, st.StartDay, at)}, nil
+	case "daily":
+		return []string{"*-*-* " + at}, nil
+	case "weekly":
+		if dow == "" && len(days) == 0 {
+			return nil, errors.New("weekly task has no days of the week")
+		}
+		return []string{fmt.Sprintf("%s*-*-* %s", dow, at)}, nil
+	case "monthly":
+		ret := make([]string, 0)
+		if d := bitsToList(uint64(st.DaysOfMonth&^lastDayOfMonthBit), 31); len(d) > 0 {
+			ret = append(ret, fmt.Sprintf("*-%s-%s %s", months, joinInts(d, "%02d"), at))
+		}
+		if st.RunOnLastDayOfMonth || st.DaysOfMonth&lastDayOfMonthBit != 0 {
+			ret = append(ret, fmt.Sprintf("*-%s~01 %s", months, at))
+		}
+		if len(ret) == 0 {
+			return nil, errors.New("monthly task has no days of the month")
+		}
+		return ret, nil
+	case "monthlydow":
+		ret := make([]string, 0)
+		for _, w := range bitsToList(uint64(st.WeeksOfMonth), 5) {
+			if w == 5 {
+				ret = append(ret, fmt.Sprintf("%s*-%s~07/1 %s", dow, months, at))
+				continue
+			}
+			ret = append(ret, fmt.Sprintf("%s*-%s-%02d..%02d %s", dow, months, (w-1)*7+1, w*7, at))
+		}
+		if len(ret) == 0 {
+			return nil, errors.New("monthlydow task has no weeks of the month")
+		}
+		return ret, nil
+	}
+	return nil, fmt.Errorf("unsupported trigger %s", st.Trigger)
+}
+
+// cronSchedule translates the trigger into a crontab schedule, the guards handle what cron cannot express
+func cronSchedule(st SchedTask) (string, error) {
+	months := "*"
+	if m := bitsToList(uint64(st.MonthsOfYear), 12); len(m) > 0 && len(m) < 12 {
+		months = joinInts(m, "%d")
+	}
+	dow := "*"
+	if d := bitsToList(uint64(st.DaysOfWeek), 7); len(d) > 0 && len(d) < 7 {
+		for i := range d {
+			d[i]--
+		}
+		dow = joinInts(d, "%d")
+	}
+
+	switch st.Trigger {
+	case "runonce":
+		return fmt.Sprintf("%d %d %d %d *", st.StartMinute, st.StartHour, st.StartDay, st.StartMonth), nil
+	case "daily":
+		return fmt.Sprintf("%d %d * * *", st.StartMinute, st.StartHour), nil
+	case "weekly":
+		return fmt.Sprintf("%d %d * * %s", st.StartMinute, st.StartHour, dow), nil
+	case "monthly":
+		days := bitsToList(uint64(st.DaysOfMonth&^lastDayOfMonthBit), 31)
+		if st.RunOnLastDayOfMonth || st.DaysOfMonth&lastDayOfMonthBit != 0 {
+			// the guard only applies when the last day is the only day, otherwise run on 28-31 and check in the guard
+			if len(days) > 0 {
+				return "", errors.New("cron cannot combine specific days with the last day of the month")
+			}
+			return fmt.Sprintf("%d %d 28-31 %s *", st.StartMinute, st.StartHour, months), nil
+		}
+		if len(days) == 0 {
+			return "", errors.New("monthly task has no days of the month")
+		}
+		return fmt.Sprintf("%d %d %s %s *", st.StartMinute, st.StartHour, joinInts(days, "%d"), months), nil
+	case "monthlydow":
+		return fmt.Sprintf("%d %d * %s %s", st.StartMinute, st.StartHour, months, dow), nil
+	}
+	return "", fmt.Errorf("unsupported trigger %s", st.Trigger)
+}
+
+func (a *Agent) CreateSchedTask(st SchedTask) (bool, error) {
+	a.Logger.Debugf("%+v\n", st)
+	if st.Name == "" {
+		return false, errors.New("task name is required")
+	}
+
+	for _, t := range ListSchedTasks() {
+		if t == st.Name {
+			if !st.Overwrite {
+				return false, fmt.Errorf("task %s already exists", st.Name)
+			}
+			if err := DeleteSchedTask(st.Name); err != nil {
+				return false, err
+			}
+			break
+		}
+	}
+
+	if systemdBooted() {
+		return a.createSystemdTask(st)
+	}
+	if trmm.FileExists(cronDir) {
+		return a.createCronTask(st)
+	}
+	return false, errors.New("neither systemd nor cron are available on this host")
+}
+
+func (a *Agent) createSystemdTask(st SchedTask) (bool, error) {
+	unit := schedTaskUnit(st.Name)
+	svcFile := filepath.Join(systemdUnitDir, unit+".service")
+	timerFile := filepath.Join(systemdUnitDir, unit+".timer")
+
+	cmd, err := a.schedTaskCommand(st)
+	if err != nil {
+		return false, err
+	}
+	cleanup := fmt.Sprintf("systemctl disable --now %s.timer; rm -f %s %s; systemctl daemon-reload", unit, shellQuote(svcFile), shellQuote(timerFile))
+	guards := schedTaskGuards(st, cleanup, false)
+	if st.Trigger == "onboarding" {
+		// OnActiveSec fires again on every boot, the first run disables the timer
+		guards = append(guards, fmt.Sprintf("systemctl disable --now %s.timer", unit))
+	}
+	script := strings.Join(append(guards, "exec "+cmd), "\n")
+	// systemd expands % specifiers and $ variables, and unquotes "..." itself
+	script = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$", "\n", "; ").Replace(script)
+
+	var svc strings.Builder
+	fmt.Fprintf(&svc, "%s%s\n", schedTaskMarker, st.Name)
+	fmt.Fprintf(&svc, "[Unit]\nDescription=TacticalRMM scheduled task %s\n\n", st.Name)
+	fmt.Fprintf(&svc, "[Service]\nType=oneshot\nExecStart=/bin/sh -c \"%s\"\n", script)
+
+	var timer strings.Builder
+	fmt.Fprintf(&timer, "%s%s\n", schedTaskMarker, st.Name)
+	fmt.Fprintf(&timer, "[Unit]\nDescription=TacticalRMM scheduled task %s\n\n[Timer]\n", st.Name)
+	switch st.Trigger {
+	case "manual":
+		// run on demand only, no timer
+	case "onboarding":
+		delay := int(st.RandomDelay.DurationApprox().Seconds())
+		if delay < 1 {
+			delay = 1
+		}
+		fmt.Fprintf(&timer, "OnActiveSec=%d\n", delay)
+	default:
+		cals, err := onCalendar(st)
+		if err != nil {
+			return false, err
+		}
+		for _, c := range cals {
+			fmt.Fprintf(&timer, "OnCalendar=%s\n", c)
+		}
+		if delay := int(st.RandomDelay.DurationApprox().Seconds()); delay > 0 {
+			fmt.Fprintf(&timer, "RandomizedDelaySec=%d\n", delay)
+		}
+		// systemd has no repetition duration, the guards skip the runs after it
+		if interval := int(st.RepetitionInterval.DurationApprox().Seconds()); interval > 0 {
+			fmt.Fprintf(&timer, "OnUnitActiveSec=%d\n", interval)
+		}
+	}
+	if st.RunASAPAfterMissed {
+		timer.WriteString("Persistent=true\n")
+	}
+	fmt.Fprintf(&timer, "AccuracySec=1s\nUnit=%s.service\n\n[Install]\nWantedBy=timers.target\n", unit)
+
+	if err := os.WriteFile(svcFile, []byte(svc.String()), 0644); err != nil {
+		return false, err
+	}
+	if st.Trigger != "manual" {
+		if err := os.WriteFile(timerFile, []byte(timer.String()), 0644); err != nil {
+			os.Remove(svcFile)
+			return false, err
+		}
+	}
+
+	out := a.systemctl("daemon-reload")
+	if out.Status.Exit != 0 {
+		return false, fmt.Errorf("systemctl daemon-reload: %s", out.Stderr)
+	}
+	if st.Enabled && st.Trigger != "manual" {
+		out = a.systemctl("enable", "--now", unit+".timer")
+		if out.Status.Error != nil {
+			return false, out.Status.Error
+		}
+		if out.Status.Exit != 0 {
+			return false, errors.New(strings.TrimSpace(out.Stderr))
+		}
+	}
+	return true, nil
+}
+
+func (a *Agent) createCronTask(st SchedTask) (bool, error) {
+	cronFile := schedTaskCronFile(st.Name)
+	cmd, err := a.schedTaskCommand(st)
+	if err != nil {
+		return false, err
+	}
+
+	if st.RepetitionInterval.DurationApprox() > 0 && st.Trigger != "manual" && st.Trigger != "onboarding" {
+		return false, errors.New("repeating a task is not supported with cron, this host needs systemd")
+	}
+	// cron has no random delay, the job sleeps for it instead
+	sleep := ""
+	if delay := int(st.RandomDelay.DurationApprox().Seconds()); delay > 0 {
+		sleep = fmt.Sprintf("sleep $(( $(od -An -N4 -tu4 /dev/urandom) %% %d ))", delay+1)
+	}
+
+	var content strings.Builder
+	fmt.Fprintf(&content, "%s%s\n", schedTaskMarker, st.Name)
+	content.WriteString("SHELL=/bin/sh\nPATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin\n")
+
+	switch st.Trigger {
+	case "manual":
+		// cron has no on demand jobs, the file only registers the task
+	default:
+		schedule := onboardingCronSchedule
+		if st.Trigger != "onboarding" {
+			var err error
+			if schedule, err = cronSchedule(st); err != nil {
+				return false, err
+			}
+		}
+		cleanup := "rm -f " + shellQuote(cronFile)
+		guards := schedTaskGuards(st, cleanup, true)
+		switch st.Trigger {
+		case "onboarding":
+			// fires within a minute and comments itself out so it only runs once, like a disabled task
+			disable := fmt.Sprintf("/^%s root /s/^/# /", regexp.QuoteMeta(schedule))
+			guards = append(guards, fmt.Sprintf("sed -i %s %s", shellQuote(disable), shellQuote(cronFile)))
+		case "runonce":
+			guards = append(guards, fmt.Sprintf(`[ "$(date +%%Y)" -eq %d ] || exit 0`, st.StartYear))
+			if st.DeleteAfter {
+				cmd += "; " + cleanup
+			}
+		}
+		if sleep != "" {
+			guards = append(guards, sleep)
+		}
+		script := strings.Join(append(guards, cmd), "; ")
+		// % is a newline in crontab commands
+		script = strings.ReplaceAll(script, "%", `\%`)
+		if st.Enabled {
+			fmt.Fprintf(&content, "%s root %s\n", schedule, script)
+		} else {
+			fmt.Fprintf(&content, "# %s root %s\n", schedule, script)
+		}
+	}
+
+	if err := os.WriteFile(cronFile, []byte(content.String()), 0644); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// schedTaskFiles returns every unit and cron file created by the agent keyed by task name
+func schedTaskFiles() map[string][]string {
+	ret := make(map[string][]string)
+	globs := []string{
+		filepath.Join(systemdUnitDir, schedTaskPrefix+"*.service"),
+		filepath.Join(systemdUnitDir, schedTaskPrefix+"*.timer"),
+		filepath.Join(cronDir, cronSchedTaskPrefx+"*"),
+	}
+	for _, g := range globs {
+		files, err := filepath.Glob(g)
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			fh, err := os.Open(f)
+			if err != nil {
+				continue
+			}
+			scanner := bufio.NewScanner(fh)
+			if scanner.Scan() {
+				if name, ok := strings.CutPrefix(scanner.Text(), schedTaskMarker); ok {
+					ret[name] = append(ret[name], f)
+				}
+			}
+			fh.Close()
+		}
+	}
+	return ret
+}
+
+func DeleteSchedTask(name string) error {
+	files := schedTaskFiles()[name]
+	if len(files) == 0 {
+		return fmt.Errorf("task %s does not exist", name)
+	}
+
+	unit := schedTaskUnit(name)
+	if systemdBooted() {
+		exec.Command("systemctl", "disable", "--now", unit+".timer").Run()
+	}
+	for _, f := range files {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if systemdBooted() {
+		exec.Command("systemctl", "daemon-reload").Run()
+	}
+	return nil
+}
+
+// ListSchedTasks only returns tasks created by the agent
+func ListSchedTasks() []string {
+	ret := make([]string, 0)
+	for name := range schedTaskFiles() {
+		ret = append(ret, name)
+	}
+	return ret
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2023 AmidaWare Inc.
+
+Licensed under the Tactical RMM License Version 1.0 (the “License”).
+You may only use the Licensed Software in accordance with the License.
+A copy of the License is available at:
+
+https://license.tacticalrmm.com
+
+*/
+
+package agent
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	rmm "github.com/amidaware/rmmagent/shared"
+	"github.com/go-resty/resty/v2"
+)
+
+const (
+	tcpCheckMaxBanner = 4096
+	// the banner is cut to this length in more_info
+	tcpCheckShowBanner = 200
+)
+
+func (a *Agent) SendTCPCheckResult(payload rmm.TCPCheckResponse, r *resty.Client) {
+	a.SendResult(r, http.MethodPatch, "/api/v3/checkrunner/", payload, checkResultTTL)
+}
+
+// TCPCheck connects to data.IP on data.Port and fails if the connect takes longer than data.MaxLatency.
+// If data.Probe is set it is sent first, escapes like \r\n are allowed.
+// If data.BannerRegex is set the response is read until it matches, the connection closes or the check times out.
+func (a *Agent) TCPCheck(data rmm.Check) (payload rmm.TCPCheckResponse) {
+	payload.ID = data.CheckPK
+	payload.AgentID = a.AgentID
+	payload.Status = "failing"
+
+	if data.IP == "" || data.Port <= 0 || data.Port > 65535 {
+		payload.MoreInfo = fmt.Sprintf("Invalid host or port: %q %d", data.IP, data.Port)
+		return
+	}
+
+	var bannerRe *regexp.Regexp
+	if data.BannerRegex != "" {
+		var err error
+		bannerRe, err = regexp.Compile(data.BannerRegex)
+		if err != nil {
+			payload.MoreInfo = fmt.Sprintf("Invalid banner regex: %v", err)
+			return
+		}
+	}
+
+	addr := net.JoinHostPort(data.IP, strconv.Itoa(data.Port))
+	timeout := checkTimeout(data)
+	conn, elapsed, err := DialTCP(addr, timeout)
+	if err != nil {
+		a.Logger.Debugln("TCPCheck:", err)
+		payload.MoreInfo = fmt.Sprintf("Connecting to %s failed: %v", addr, err)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	payload.ConnectTime = elapsed.Milliseconds()
+	info := fmt.Sprintf("Connected to %s in %dms", addr, payload.ConnectTime)
+
+	problems := make([]string, 0)
+	if p := overLatency(data, elapsed); p != "" {
+		problems = append(problems, p)
+	}
+
+	if data.Probe != "" {
+		if _, err := conn.Write([]byte(unescapeProbe(data.Probe))); err != nil {
+			problems = append(problems, fmt.Sprintf("sending the probe failed: %v", err))
+		}
+	}
+
+	if bannerRe != nil && len(problems) == 0 {
+		banner, err := readBanner(conn, bannerRe)
+		payload.Banner = CleanString(banner)
+		shown := payload.Banner
+		if len(shown) > tcpCheckShowBanner {
+			shown = shown[:tcpCheckShowBanner] + "..."
+		}
+		info += fmt.Sprintf(", banner: %q", shown)
+		if !bannerRe.MatchString(banner) {
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("banner does not match %q: %v", data.BannerRegex, err))
+			} else {
+				problems = append(problems, fmt.Sprintf("banner does not match %q", data.BannerRegex))
+			}
+		}
+	}
+
+	payload.MoreInfo = info
+	if len(problems) > 0 {
+		payload.MoreInfo += "\n" + strings.Join(problems, "\n")
+		return
+	}
+	payload.Status = "passing"
+	return
+}
+
+// readBanner reads from conn until re matches what was read so far, the error is from the last read
+func readBanner(conn net.Conn, re *regexp.Regexp) (string, error) {
+	var banner []byte
+	buf := make([]byte, 1024)
+	for len(banner) < tcpCheckMaxBanner {
+		n, err := conn.Read(buf)
+		banner = append(banner, buf[:n]...)
+		if re.Match(banner) {
+			return string(banner), nil
+		}
+		if err != nil {
+			return string(banner), err
+		}
+	}
+	return string(banner), nil
+}
+
+// unescapeProbe turns escapes like \r\n in a probe into the characters, the probe is sent as is if it is not valid
+func unescapeProbe(probe string) string {
+	s, err := strconv.Unquote(`"` + strings.ReplaceAll(probe, `"`, `\"`) + `"`)
+	if err != nil {
+		return probe
+	}
+	return s
+}
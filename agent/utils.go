@@ -94,8 +94,8 @@ func (a *Agent) PublicIP() string {
 	client := resty.New()
 	client.SetHeader("User-Agent", a.AgentHeader)
 	client.SetTimeout(4 * time.Second)
-	if len(a.Proxy) > 0 {
-		client.SetProxy(a.Proxy)
+	if proxy := a.settings().Proxy; len(proxy) > 0 {
+		client.SetProxy(proxy)
 	}
 	urls := []string{"https://icanhazip.tacticalrmm.io/", "https://icanhazip.com", "https://ifconfig.co/ip"}
 	ip := "error"
@@ -216,13 +216,20 @@ func DjangoStringResp(resp string) string {
 	return strings.Trim(resp, `"`)
 }
 
-func TestTCP(addr string) error {
-	conn, err := net.Dial("tcp4", addr)
+// TestTCP reports whether addr accepts a tcp connection within timeout
+func TestTCP(addr string, timeout time.Duration) error {
+	conn, _, err := DialTCP(addr, timeout)
 	if err != nil {
 		return err
 	}
-	defer conn.Close()
-	return nil
+	return conn.Close()
+}
+
+// DialTCP connects to addr and returns the connection and how long the connect took
+func DialTCP(addr string, timeout time.Duration) (net.Conn, time.Duration, error) {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	return conn, time.Since(start), err
 }
 
 // CleanString removes invalid utf-8 byte sequences
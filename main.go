@@ -16,7 +16,6 @@ import (
 	"fmt"
 	"os"
 	"os/user"
-	"path/filepath"
 	"runtime"
 
 	"github.com/amidaware/rmmagent/agent"
@@ -55,6 +54,7 @@ func main() {
 	proxy := flag.String("proxy", "", "Use a http proxy")
 	insecure := flag.Bool("insecure", false, "Insecure for testing only")
 	natsport := flag.String("natsport", "", "nats standard port")
+	jsonOut := flag.Bool("json", false, "Print json output")
 	flag.Parse()
 
 	if *ver {
@@ -103,6 +103,14 @@ func main() {
 		}
 	case "pk":
 		fmt.Println(a.AgentPK)
+	case "config":
+		os.Exit(agent.ConfigCLI(flag.Args()))
+	case "doctor":
+		os.Exit(a.Doctor(*jsonOut))
+	case "status":
+		os.Exit(agent.LocalStatus(*jsonOut))
+	case "local":
+		os.Exit(agent.LocalCLI(flag.Args()))
 	case "winagentsvc":
 		fmt.Println("deprecated. use 'svc'")
 	case "runchecks":
@@ -182,12 +190,7 @@ func setupLogging(level, to *string) {
 	if *to == "stdout" {
 		log.SetOutput(os.Stdout)
 	} else {
-		switch runtime.GOOS {
-		case "windows":
-			logFile, _ = os.OpenFile(filepath.Join(os.Getenv("ProgramFiles"), "TacticalAgent", "agent.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
-		default:
-			logFile, _ = os.OpenFile(filepath.Join("/var/log/", "tacticalagent.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
-		}
+		logFile, _ = os.OpenFile(agent.LogFilePath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
 		log.SetOutput(logFile)
 	}
 }
@@ -49,20 +49,100 @@ type AgentConfig struct {
 	NatsStandardPort   string
 	NatsPingInterval   int
 	Insecure           string
+	RPCWorkers         int
+	RPCQueueSize       int
+	RPCControlWorkers  int
+	RPCControlQueue    int
 }
 
 type RunScriptResp struct {
-	Stdout   string  `json:"stdout"`
-	Stderr   string  `json:"stderr"`
-	Retcode  int     `json:"retcode"`
-	ExecTime float64 `json:"execution_time"`
-	ID       int     `json:"id"`
+	Stdout     string        `json:"stdout"`
+	Stderr     string        `json:"stderr"`
+	Retcode    int           `json:"retcode"`
+	ExecTime   float64       `json:"execution_time"`
+	ID         int           `json:"id"`
+	Structured *ScriptOutput `json:"structured,omitempty"`
+}
+
+// ScriptOutput is the structured data a script printed as "##trmm {json}" lines, see agent.parseScriptOutput()
+type ScriptOutput struct {
+	Data         map[string]interface{} `json:"data,omitempty"`
+	Perf         []PerfData             `json:"perf,omitempty"`
+	CustomFields map[string]string      `json:"custom_fields,omitempty"`
+	Errors       []string               `json:"errors,omitempty"`
+}
+
+type PerfData struct {
+	Label string   `json:"label"`
+	Value float64  `json:"value"`
+	Unit  string   `json:"unit,omitempty"`
+	Warn  *float64 `json:"warn,omitempty"`
+	Crit  *float64 `json:"crit,omitempty"`
+	Min   *float64 `json:"min,omitempty"`
+	Max   *float64 `json:"max,omitempty"`
 }
 
 type RawCMDResp struct {
 	Results string `json:"results"`
 }
 
+// ChunkManifest replaces an rpc response that does not fit in one nats message.
+// The Parts ChunkPart messages are published to Subject, the chunk_subject the caller
+// sent with the request and subscribed to before sending it.
+type ChunkManifest struct {
+	Chunked bool   `json:"__chunked"`
+	ID      string `json:"id"`
+	Subject string `json:"subject"`
+	Parts   int    `json:"parts"`
+	Size    int    `json:"size"`
+	SHA256  string `json:"sha256"`
+}
+
+// ChunkPart holds bytes [Part*chunk size, (Part+1)*chunk size) of the msgpack encoded response
+type ChunkPart struct {
+	ID   string `json:"id"`
+	Part int    `json:"part"`
+	Data []byte `json:"data"`
+}
+
+// ScriptStreamMsg is published to the stream subject of runscript and rawcmd while the process runs
+// the last message has Done set and carries the exit status instead of output
+type ScriptStreamMsg struct {
+	ID       int     `json:"id"`
+	Seq      int     `json:"seq"`
+	Stream   string  `json:"stream"`
+	Data     string  `json:"data"`
+	Done     bool    `json:"done"`
+	Retcode  int     `json:"retcode"`
+	ExecTime float64 `json:"execution_time"`
+}
+
+// The local api relays submissions to the rmm like the check-ins in natsCheckin:
+// msgpack published to the subject <agent_id> with the reply subject set to the mode.
+// The rmm's nats handler has to implement these modes, they are fire and forget so the agent gets no answer:
+//   agent-customfields  LocalCustomFieldsNats  set the agent custom fields named in Fields, by field name
+//   agent-alert         LocalAlertNats         raise an alert on the agent, Severity is info, warning or error
+//   agent-note          LocalNoteNats          add a note to the agent
+
+// LocalCustomFieldsNats relays custom field values a local process submitted through the local api
+type LocalCustomFieldsNats struct {
+	Agentid string            `json:"agent_id"`
+	Fields  map[string]string `json:"fields"`
+}
+
+// LocalAlertNats relays an alert a local process raised through the local api
+type LocalAlertNats struct {
+	Agentid  string `json:"agent_id"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// LocalNoteNats relays a note a local process added through the local api
+type LocalNoteNats struct {
+	Agentid string `json:"agent_id"`
+	Note    string `json:"note"`
+}
+
 type AgentInfo struct {
 	AgentPK      int     `json:"id"`
 	Version      string  `json:"version"`
@@ -82,6 +162,62 @@ type PingCheckResponse struct {
 	Output  string `json:"output"`
 }
 
+type HTTPCheckResponse struct {
+	ID           int    `json:"id"`
+	AgentID      string `json:"agent_id"`
+	Status       string `json:"status"`
+	MoreInfo     string `json:"more_info"`
+	StatusCode   int    `json:"status_code"`
+	ResponseTime int64  `json:"response_time_ms"`
+	CertDaysLeft *int   `json:"cert_days_left,omitempty"`
+}
+
+type TCPCheckResponse struct {
+	ID          int    `json:"id"`
+	AgentID     string `json:"agent_id"`
+	Status      string `json:"status"`
+	MoreInfo    string `json:"more_info"`
+	ConnectTime int64  `json:"connect_time_ms"`
+	Banner      string `json:"banner"`
+}
+
+type CertInfo struct {
+	Source    string    `json:"source"`
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	SANs      []string  `json:"sans"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	DaysLeft  int       `json:"days_left"`
+	Problems  []string  `json:"problems"`
+	InfoOnly  bool      `json:"info_only"`
+}
+
+type CertCheckResponse struct {
+	ID       int        `json:"id"`
+	AgentID  string     `json:"agent_id"`
+	Status   string     `json:"status"`
+	MoreInfo string     `json:"more_info"`
+	Certs    []CertInfo `json:"certs"`
+}
+
+type DNSCheckResponse struct {
+	ID           int      `json:"id"`
+	AgentID      string   `json:"agent_id"`
+	Status       string   `json:"status"`
+	MoreInfo     string   `json:"more_info"`
+	Answers      []string `json:"answers"`
+	ResponseTime int64    `json:"response_time_ms"`
+}
+
+type ProcessCheckResponse struct {
+	ID       int     `json:"id"`
+	AgentID  string  `json:"agent_id"`
+	Status   string  `json:"status"`
+	MoreInfo string  `json:"more_info"`
+	PIDs     []int32 `json:"pids"`
+}
+
 type WinUpdateResult struct {
 	AgentID string       `json:"agent_id"`
 	Updates []WUAPackage `json:"wua_updates"`
@@ -182,6 +318,33 @@ type Check struct {
 	EventMessage           string         `json:"event_message"`
 	FailWhen               string         `json:"fail_when"`
 	SearchLastDays         int            `json:"search_last_days"`
+	URL                    string         `json:"url"`
+	Method                 string         `json:"method"`
+	ExpectedStatusCodes    []int          `json:"expected_status_codes"`
+	BodyRegex              string         `json:"body_regex"`
+	MaxLatency             int            `json:"max_latency_ms"`
+	IgnoreTLSErrors        bool           `json:"ignore_tls_errors"`
+	Port                   int            `json:"port"`
+	Probe                  string         `json:"probe"`
+	BannerRegex            string         `json:"banner_regex"`
+	ServerName             string         `json:"server_name"`
+	StartTLS               string         `json:"starttls"`
+	CertPath               string         `json:"cert_path"`
+	WarnDays               int            `json:"warn_days"`
+	FailDays               int            `json:"fail_days"`
+	DNSName                string         `json:"dns_name"`
+	RecordType             string         `json:"record_type"`
+	DNSServer              string         `json:"dns_server"`
+	ExpectedAnswers        []string       `json:"expected_answers"`
+	ExpectedRegex          string         `json:"expected_regex"`
+	ProcessName            string         `json:"process_name"`
+	ProcessExe             string         `json:"process_exe"`
+	CmdlineRegex           string         `json:"cmdline_regex"`
+	MinInstances           *int           `json:"min_instances"`
+	MaxInstances           *int           `json:"max_instances"`
+	MaxCPUPercent          float64        `json:"max_cpu_percent"`
+	MaxRSSMB               int            `json:"max_rss_mb"`
+	MaxOpenFiles           int            `json:"max_open_files"`
 }
 
 type AllChecks struct {